@@ -0,0 +1,199 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/utilitywarehouse/semaphore-policy/log"
+	"github.com/utilitywarehouse/semaphore-policy/metrics"
+)
+
+// SchemaVersion is the version of the entry schema. Fields are only added to
+// a version, any other change bumps it.
+const SchemaVersion = 1
+
+// Action is the change of the membership of an ip
+type Action string
+
+const (
+	ActionAdded   Action = "added"
+	ActionRemoved Action = "removed"
+)
+
+// Reason is the cause of a membership change
+type Reason string
+
+const (
+	// ReasonAdd, ReasonModify and ReasonDelete follow the remote pod events
+	ReasonAdd    Reason = "add"
+	ReasonModify Reason = "modify"
+	ReasonDelete Reason = "delete"
+	// ReasonTakeover is the removal of a net held down in a set once
+	// another pod takes its ip over
+	ReasonTakeover Reason = "takeover"
+	// ReasonGC is the removal of a set that is no longer in the store
+	ReasonGC Reason = "gc"
+	// ReasonDriftRevert is the revert of a change made to a set outside of
+	// the operator
+	ReasonDriftRevert Reason = "drift-revert"
+)
+
+// Entry records an ip added to or removed from a network set
+type Entry struct {
+	Version   int       `json:"version"`
+	Time      time.Time `json:"time"`
+	Action    Action    `json:"action"`
+	Reason    Reason    `json:"reason"`
+	IP        string    `json:"ip"`
+	Net       string    `json:"net"`
+	Set       string    `json:"set"`
+	Cluster   string    `json:"cluster"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod,omitempty"`
+}
+
+// Logger writes audit entries as JSON lines. A nil Logger discards them.
+type Logger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// New returns a Logger that writes to w
+func New(w io.Writer) *Logger {
+	return &Logger{w: w}
+}
+
+// NewFile returns a Logger that appends to the file at path, rotating it once
+// it grows over maxSize bytes and keeping maxBackups rotated files.
+func NewFile(path string, maxSize int64, maxBackups int) (*Logger, error) {
+	f, err := openRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return New(f), nil
+}
+
+// Record writes an entry, filling in its version and time
+func (l *Logger) Record(e Entry) {
+	if l == nil {
+		return
+	}
+	e.Version = SchemaVersion
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Audit.Error("failed to encode audit entry", "err", err)
+		metrics.IncAuditWriteErrors()
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(data, '\n')); err != nil {
+		log.Audit.Error("failed to write audit entry", "err", err)
+		metrics.IncAuditWriteErrors()
+	}
+}
+
+// Close closes the underlying writer, if it can be closed
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.w.(io.Closer); ok && l.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// rotatingFile is an append only file that is rotated to path.1, path.2, ...
+// once it grows over maxSize
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("max size must be positive, got %d", maxSize)
+	}
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("cannot open audit log: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("cannot stat audit log: %v", err)
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would not fit. Writes
+// are not split across files. If the rotation fails, p is appended to the
+// current file anyway and the rotation is retried on the next write, so that
+// no entry is lost.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			log.Audit.Error("failed to rotate audit log", "err", err)
+			metrics.IncAuditWriteErrors()
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file aside before closing it, so that the current file is
+// kept open if any step fails
+func (rf *rotatingFile) rotate() error {
+	if rf.maxBackups > 0 {
+		os.Remove(rf.backup(rf.maxBackups))
+		for i := rf.maxBackups - 1; i > 0; i-- {
+			if err := os.Rename(rf.backup(i), rf.backup(i+1)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("cannot rotate audit log: %v", err)
+			}
+		}
+		if err := os.Rename(rf.path, rf.backup(1)); err != nil {
+			return fmt.Errorf("cannot rotate audit log: %v", err)
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return fmt.Errorf("cannot rotate audit log: %v", err)
+	}
+	old := rf.f
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if err := old.Close(); err != nil {
+		return fmt.Errorf("cannot close rotated audit log: %v", err)
+	}
+	return nil
+}
+
+func (rf *rotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", rf.path, i)
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.f.Close()
+}
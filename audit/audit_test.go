@@ -0,0 +1,105 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+func TestRecord(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf)
+	l.Record(Entry{Action: ActionAdded, Reason: ReasonAdd, IP: "10.0.0.1", Net: "10.0.0.1/32", Set: "set", Cluster: "c", Namespace: "ns", Pod: "pod"})
+	var e map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &e))
+	assert.Equal(t, float64(SchemaVersion), e["version"])
+	assert.Equal(t, "added", e["action"])
+	assert.Equal(t, "add", e["reason"])
+	assert.Equal(t, "10.0.0.1", e["ip"])
+	assert.Equal(t, "pod", e["pod"])
+	assert.NotEmpty(t, e["time"])
+
+	// A nil logger discards entries
+	var nilLogger *Logger
+	nilLogger.Record(Entry{})
+	assert.NoError(t, nilLogger.Close())
+}
+
+func TestFileRotation(t *testing.T) {
+	log.InitLogger("test", "debug")
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := NewFile(path, 300, 2)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		l.Record(Entry{Action: ActionAdded, Reason: ReasonAdd, IP: "10.0.0.1", Net: "10.0.0.1/32", Set: "set"})
+	}
+	assert.NoError(t, l.Close())
+
+	// Entries are not split across files, and only the backups to keep
+	// are left
+	total := 0
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, info.Size(), int64(300))
+		f, err := os.Open(p)
+		assert.NoError(t, err)
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			var e Entry
+			assert.NoError(t, json.Unmarshal(s.Bytes(), &e))
+			total++
+		}
+		f.Close()
+	}
+	assert.Less(t, total, 10)
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Reopening appends to the current file
+	path = filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		l, err = NewFile(path, 1024*1024, 2)
+		assert.NoError(t, err)
+		l.Record(Entry{Action: ActionRemoved, Reason: ReasonGC, Set: "set"})
+		assert.NoError(t, l.Close())
+	}
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(data, []byte("\n")))
+}
+
+func TestFileRotationFailure(t *testing.T) {
+	log.InitLogger("test", "debug")
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// A non empty directory in the way of the backup makes the rename fail
+	assert.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocker"), 0750))
+	l, err := NewFile(path, 300, 1)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		l.Record(Entry{Action: ActionAdded, Reason: ReasonAdd, IP: "10.0.0.1", Net: "10.0.0.1/32", Set: "set"})
+	}
+
+	// Entries keep being appended to the current file
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, bytes.Count(data, []byte("\n")))
+
+	// Rotation is retried once the way is clear
+	assert.NoError(t, os.RemoveAll(path+".1"))
+	l.Record(Entry{Action: ActionRemoved, Reason: ReasonDelete, IP: "10.0.0.1", Net: "10.0.0.1/32", Set: "set"})
+	assert.NoError(t, l.Close())
+	data, err = os.ReadFile(path + ".1")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, bytes.Count(data, []byte("\n")))
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, bytes.Count(data, []byte("\n")))
+}
@@ -3,79 +3,202 @@ package calico
 import (
 	"context"
 	"fmt"
+	"time"
 
 	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
 	"github.com/projectcalico/api/pkg/client/clientset_generated/clientset"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/utilitywarehouse/semaphore-policy/kube"
 	"github.com/utilitywarehouse/semaphore-policy/log"
 	"github.com/utilitywarehouse/semaphore-policy/metrics"
+	"github.com/utilitywarehouse/semaphore-policy/tracing"
 )
 
+// requestTimeout bounds each request to the calico API, so that a hung call
+// cannot block the sync loop forever
+var requestTimeout = 30 * time.Second
+
+// SetRequestTimeout sets the timeout of each request to the calico API
+func SetRequestTimeout(timeout time.Duration) {
+	requestTimeout = timeout
+}
+
+func requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, requestTimeout)
+}
+
+// startSpan starts a client span for a request to the calico API
+func startSpan(ctx context.Context, op, name string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "calico "+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("globalnetworkset", name)),
+	)
+}
+
 // ClientFromConfig returns a calico client (clientset) from the kubeconfig
-// path or from the in-cluster service account environment.
-func ClientFromConfig(path string) (*clientset.Clientset, error) {
-	conf, err := kube.GetClientConfig(path)
+// path and context or from the in-cluster service account environment.
+func ClientFromConfig(path, context string, opts kube.ClientOptions) (*clientset.Clientset, error) {
+	conf, err := kube.GetClientConfig(path, context, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get Calico client config: %v", err)
 	}
 	return clientset.NewForConfig(conf)
 }
 
-// CreateOrUpdateGlobalNetworkSet will try to get a globalNetworkSet and update if exists, otherwise create a new one
-func CreateOrUpdateGlobalNetworkSet(client *clientset.Clientset, name string, labels map[string]string, nets []string) error {
-	ctx := context.Background()
+// GetGlobalNetworkSet returns the GlobalNetworkSet with the given name, or nil
+// if it does not exist
+func GetGlobalNetworkSet(ctx context.Context, client *clientset.Clientset, name string) (*v3.GlobalNetworkSet, error) {
+	ctx, span := startSpan(ctx, "get", name)
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	start := time.Now()
 	gns, err := client.ProjectcalicoV3().GlobalNetworkSets().Get(ctx, name, metav1.GetOptions{})
+	metrics.ObserveCalicoClientRequestDuration("get", start)
 	if errors.IsNotFound(err) {
-		log.Logger.Debug("GlobalNetworkSet NotFound error returned from apiserver", "set", name)
+		log.Calico.Debug("GlobalNetworkSet NotFound error returned from apiserver", "set", name)
 		metrics.IncCalicoClientRequest("get", nil) // Don't record an error since ErrorResourceDoesNotExist is expected at this point
-		// Try creating if the resource does not exist
-		gns = &v3.GlobalNetworkSet{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:   name,
-				Labels: labels,
-			},
-			Spec: v3.GlobalNetworkSetSpec{Nets: nets},
-		}
-		_, err := client.ProjectcalicoV3().GlobalNetworkSets().Create(ctx, gns, metav1.CreateOptions{})
-		metrics.IncCalicoClientRequest("create", err)
-		return err
+		span.SetAttributes(attribute.Bool("found", false))
+		span.End()
+		return nil, nil
 	}
 	metrics.IncCalicoClientRequest("get", err)
+	tracing.End(span, err)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return gns, nil
+}
+
+// Action is the change applied to a GlobalNetworkSet
+type Action string
+
+const (
+	ActionNone    Action = ""
+	ActionCreated Action = "Created"
+	ActionUpdated Action = "Updated"
+	ActionDeleted Action = "Deleted"
+)
+
+// CreateOrUpdateGlobalNetworkSet will try to get a globalNetworkSet and update if exists, otherwise create a new one.
+// Sets that are already up to date are not updated.
+func CreateOrUpdateGlobalNetworkSet(ctx context.Context, client *clientset.Clientset, name string, labels map[string]string, nets []string) (action Action, err error) {
+	ctx, span := tracing.Start(ctx, "calico create or update",
+		trace.WithAttributes(attribute.String("globalnetworkset", name), attribute.Int("nets", len(nets))),
+	)
+	defer func() {
+		span.SetAttributes(attribute.String("action", string(action)))
+		tracing.End(span, err)
+	}()
+	gns, err := GetGlobalNetworkSet(ctx, client, name)
+	if err != nil {
+		return ActionNone, err
+	}
+	if gns == nil {
+		if err := CreateGlobalNetworkSet(ctx, client, name, labels, nets); err != nil {
+			return ActionNone, err
+		}
+		return ActionCreated, nil
+	}
+	if !NeedsUpdate(gns, labels, nets) {
+		return ActionNone, nil
 	}
-	// Else update the existing one
 	gns.Labels = labels
 	gns.Spec.Nets = nets
-	_, err = client.ProjectcalicoV3().GlobalNetworkSets().Update(ctx, gns, metav1.UpdateOptions{})
+	if err := UpdateGlobalNetworkSet(ctx, client, gns); err != nil {
+		return ActionNone, err
+	}
+	return ActionUpdated, nil
+}
+
+// NeedsUpdate returns true if the labels or nets of a GlobalNetworkSet differ
+// from the given ones
+func NeedsUpdate(gns *v3.GlobalNetworkSet, labels map[string]string, nets []string) bool {
+	if len(gns.Labels) != len(labels) || len(gns.Spec.Nets) != len(nets) {
+		return true
+	}
+	for k, v := range labels {
+		if current, ok := gns.Labels[k]; !ok || current != v {
+			return true
+		}
+	}
+	for i, net := range nets {
+		if gns.Spec.Nets[i] != net {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateGlobalNetworkSet creates a new GlobalNetworkSet
+func CreateGlobalNetworkSet(ctx context.Context, client *clientset.Clientset, name string, labels map[string]string, nets []string) error {
+	gns := &v3.GlobalNetworkSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: v3.GlobalNetworkSetSpec{Nets: nets},
+	}
+	ctx, span := startSpan(ctx, "create", name)
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	start := time.Now()
+	_, err := client.ProjectcalicoV3().GlobalNetworkSets().Create(ctx, gns, metav1.CreateOptions{})
+	metrics.ObserveCalicoClientRequestDuration("create", start)
+	metrics.IncCalicoClientRequest("create", err)
+	tracing.End(span, err)
+	return err
+}
+
+// UpdateGlobalNetworkSet updates an existing GlobalNetworkSet
+func UpdateGlobalNetworkSet(ctx context.Context, client *clientset.Clientset, gns *v3.GlobalNetworkSet) error {
+	ctx, span := startSpan(ctx, "update", gns.Name)
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	start := time.Now()
+	_, err := client.ProjectcalicoV3().GlobalNetworkSets().Update(ctx, gns, metav1.UpdateOptions{})
+	metrics.ObserveCalicoClientRequestDuration("update", start)
 	metrics.IncCalicoClientRequest("update", err)
+	tracing.End(span, err)
 	return err
 }
 
 // DeleteGlobalNetworkSet will try to delete a GlobalNetworkSet
-func DeleteGlobalNetworkSet(client *clientset.Clientset, name string) error {
-	ctx := context.Background()
+func DeleteGlobalNetworkSet(ctx context.Context, client *clientset.Clientset, name string) error {
+	ctx, span := startSpan(ctx, "delete", name)
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	start := time.Now()
 	err := client.ProjectcalicoV3().GlobalNetworkSets().Delete(ctx, name, metav1.DeleteOptions{})
+	metrics.ObserveCalicoClientRequestDuration("delete", start)
 	if errors.IsNotFound(err) {
-		log.Logger.Warn("Apiserver returned a NotFound error on GlobalNetworkSet deletion request, skipping deletion op", "name", name)
+		log.Calico.Warn("Apiserver returned a NotFound error on GlobalNetworkSet deletion request, skipping deletion op", "name", name)
 		metrics.IncCalicoClientRequest("delete", nil)
+		span.SetAttributes(attribute.Bool("found", false))
+		span.End()
 		return nil
 	}
 	metrics.IncCalicoClientRequest("delete", err)
+	tracing.End(span, err)
 	return err
 }
 
 // GlobalNetworkSetList returns a list of sets that can match all the passed
 // labels (AND matching)
-func GlobalNetworkSetList(client *clientset.Clientset, labels map[string]string) ([]v3.GlobalNetworkSet, error) {
-	ctx := context.Background()
+func GlobalNetworkSetList(ctx context.Context, client *clientset.Clientset, labels map[string]string) ([]v3.GlobalNetworkSet, error) {
+	ctx, span := tracing.Start(ctx, "calico list", trace.WithSpanKind(trace.SpanKindClient))
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
 	// calico GlobalNetworkSets List cannot use labels as selector, so we
 	// will have to fetch them all and make the selection manually
+	start := time.Now()
 	netsetlist, err := client.ProjectcalicoV3().GlobalNetworkSets().List(ctx, metav1.ListOptions{})
+	metrics.ObserveCalicoClientRequestDuration("list", start)
 	metrics.IncCalicoClientRequest("list", err)
+	tracing.End(span, err)
 	if err != nil {
 		return []v3.GlobalNetworkSet{}, err
 	}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+
+	"github.com/utilitywarehouse/semaphore-policy/calico"
+)
+
+// setsHandler serves the state of the network sets in the store as JSON
+func setsHandler(nss *NetworkSetStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, nss.Status())
+	}
+}
+
+// SetDiff describes the differences between a set in the store and the
+// respective GlobalNetworkSet
+type SetDiff struct {
+	ID       string `json:"id"`
+	InStore  bool   `json:"inStore"`
+	InCalico bool   `json:"inCalico"`
+	// Missing holds the nets of the store missing from calico, and Extra
+	// the nets in calico that are not in the store
+	Missing []string `json:"missing"`
+	Extra   []string `json:"extra"`
+	// Labels holds the labels with different values, as {store, calico}
+	Labels map[string][2]string `json:"labels,omitempty"`
+	// PendingRemoval holds the nets that are held down. They stay in the
+	// store until the hold-down expires, and are not reported as missing
+	// from calico meanwhile.
+	PendingRemoval []string `json:"pendingRemoval,omitempty"`
+	HeldDeletions  int      `json:"heldDeletions,omitempty"`
+}
+
+// diffSet compares a set in the store with the live GlobalNetworkSet
+func diffSet(nss *NetworkSetStore, id string, gns *v3.GlobalNetworkSet) SetDiff {
+	labels, nets, inStore := nss.get(id)
+	diff := SetDiff{
+		ID:       id,
+		InStore:  inStore,
+		InCalico: gns != nil,
+		Missing:  []string{},
+		Extra:    []string{},
+	}
+	var liveLabels map[string]string
+	var liveNets []string
+	if gns != nil {
+		liveLabels, liveNets = gns.Labels, gns.Spec.Nets
+	}
+	nss.mu.Lock()
+	if netset, ok := nss.store[id]; ok {
+		for net := range netset.pendingRemoval {
+			diff.PendingRemoval = append(diff.PendingRemoval, net)
+		}
+	}
+	nss.mu.Unlock()
+	sort.Strings(diff.PendingRemoval)
+	// nets held down are still in the set
+	var want []string
+	for _, net := range nets {
+		if _, found := inSlice(diff.PendingRemoval, net); !found {
+			want = append(want, net)
+		}
+	}
+	for _, net := range want {
+		if _, found := inSlice(liveNets, net); !found {
+			diff.Missing = append(diff.Missing, net)
+		}
+	}
+	for _, net := range liveNets {
+		if _, found := inSlice(nets, net); !found {
+			diff.Extra = append(diff.Extra, net)
+		}
+	}
+	for k := range mergeLabelKeys(labels, liveLabels) {
+		if labels[k] != liveLabels[k] {
+			if diff.Labels == nil {
+				diff.Labels = make(map[string][2]string)
+			}
+			diff.Labels[k] = [2]string{labels[k], liveLabels[k]}
+		}
+	}
+	if nss.protection != nil {
+		diff.HeldDeletions = nss.protection.held()[id]
+	}
+	return diff
+}
+
+func mergeLabelKeys(a, b map[string]string) map[string]bool {
+	keys := make(map[string]bool, len(a)+len(b))
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	return keys
+}
+
+// setDiffHandler serves the differences between a set in the store and the
+// live GlobalNetworkSet as JSON
+func setDiffHandler(nss *NetworkSetStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		gns, err := calico.GetGlobalNetworkSet(r.Context(), nss.client, id)
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		diff := diffSet(nss, id, gns)
+		if !diff.InStore && !diff.InCalico {
+			writeJSON(w, http.StatusNotFound, diff)
+			return
+		}
+		writeJSON(w, http.StatusOK, diff)
+	}
+}
+
+// queueHandler serves the syncs waiting to run as JSON
+func queueHandler(nss *NetworkSetStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, nss.QueueStatus())
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/utilitywarehouse/semaphore-policy/audit"
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+func TestDiffSet(t *testing.T) {
+	log.InitLogger("test", "debug")
+	nss := &NetworkSetStore{
+		store:   make(map[string]*NetworkSet),
+		cluster: "test",
+	}
+	nss.AddNet("name", "namespace", "10.0.0.1/32", "pod-1", audit.ReasonAdd)
+	nss.AddNet("name", "namespace", "10.0.0.2/32", "pod-2", audit.ReasonAdd)
+	id := makeNetworkSetID("name", "namespace", "test")
+	labels, _, _ := nss.get(id)
+
+	gns := &v3.GlobalNetworkSet{
+		ObjectMeta: metav1.ObjectMeta{Name: id, Labels: map[string]string{labelManagedBy: "someone-else"}},
+		Spec:       v3.GlobalNetworkSetSpec{Nets: []string{"10.0.0.2/32", "10.0.0.3/32"}},
+	}
+	diff := diffSet(nss, id, gns)
+	assert.True(t, diff.InStore)
+	assert.True(t, diff.InCalico)
+	assert.Equal(t, []string{"10.0.0.1/32"}, diff.Missing)
+	assert.Equal(t, []string{"10.0.0.3/32"}, diff.Extra)
+	assert.Equal(t, [2]string{valueManagedBy, "someone-else"}, diff.Labels[labelManagedBy])
+	assert.Equal(t, [2]string{"namespace", ""}, diff.Labels[labelNetSetNamespace])
+
+	gns.Labels = labels
+	gns.Spec.Nets = []string{"10.0.0.1/32", "10.0.0.2/32"}
+	diff = diffSet(nss, id, gns)
+	assert.Equal(t, 0, len(diff.Missing))
+	assert.Equal(t, 0, len(diff.Extra))
+	assert.Nil(t, diff.Labels)
+
+	diff = diffSet(nss, "unknown", nil)
+	assert.False(t, diff.InStore)
+	assert.False(t, diff.InCalico)
+}
+
+func TestDebugHandlers(t *testing.T) {
+	log.InitLogger("test", "debug")
+	nss := &NetworkSetStore{
+		store:     make(map[string]*NetworkSet),
+		cluster:   "test",
+		syncQueue: make(chan SyncObject),
+	}
+	nss.AddNet("name", "namespace", "10.0.0.1/32", "pod-1", audit.ReasonAdd)
+
+	rec := httptest.NewRecorder()
+	setsHandler(nss)(rec, httptest.NewRequest(http.MethodGet, "/debug/sets", nil))
+	var sets []NetworkSetStatus
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&sets))
+	assert.Equal(t, 1, len(sets))
+	assert.Equal(t, map[string]string{"10.0.0.1/32": "pod-1"}, sets[0].Pods)
+
+	// A sync waiting for the sync loop is reported as pending
+	done := make(chan struct{})
+	go func() {
+		nss.EnqueueNetSetSync(context.Background(), "name", "namespace")
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return len(nss.QueueStatus().Pending) == 1 }, time.Second, time.Millisecond)
+	rec = httptest.NewRecorder()
+	queueHandler(nss)(rec, httptest.NewRequest(http.MethodGet, "/debug/queue", nil))
+	var queue QueueStatus
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&queue))
+	assert.Equal(t, makeNetworkSetID("name", "namespace", "test"), queue.Pending[0].ID)
+	<-nss.syncQueue
+	<-done
+	assert.Equal(t, 0, len(nss.QueueStatus().Pending))
+}
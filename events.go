@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/utilitywarehouse/semaphore-policy/calico"
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+// syncFailureEventThreshold is the number of consecutive failures to sync a
+// set before an event is recorded for it
+const syncFailureEventThreshold = 3
+
+// namespaceLookupTTL is the time the existence of a local namespace is cached
+// for
+const namespaceLookupTTL = time.Minute
+
+// setEvents records Kubernetes events about the GlobalNetworkSets on the local
+// cluster. GlobalNetworkSets are cluster scoped, so the events are recorded in
+// the local namespace named after the remote namespace of each set, for the
+// team owning the remote pods to find them, unless a namespace is configured.
+// Remote namespaces that do not exist locally fall back to the namespace of
+// the operator, as events in missing namespaces are rejected.
+type setEvents struct {
+	recorder          record.EventRecorder
+	namespace         string
+	fallbackNamespace string
+	// client looks up the local namespaces, which are assumed to exist if
+	// it is nil
+	client kubernetes.Interface
+
+	mu         sync.Mutex
+	namespaces map[string]namespaceLookup
+}
+
+// namespaceLookup caches whether a local namespace exists
+type namespaceLookup struct {
+	exists bool
+	at     time.Time
+}
+
+// newSetEvents returns a recorder that sends events to the API server, with
+// bursts of up to burst events per set, refilled at qps.
+func newSetEvents(client kubernetes.Interface, namespace, fallbackNamespace string, burst int, qps float32) *setEvents {
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize: burst,
+		QPS:       qps,
+	})
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return &setEvents{
+		recorder:          broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: valueManagedBy}),
+		namespace:         namespace,
+		fallbackNamespace: fallbackNamespace,
+		client:            client,
+	}
+}
+
+func (e *setEvents) reference(id string, labels map[string]string) *v1.ObjectReference {
+	namespace := e.namespace
+	if namespace == "" {
+		namespace = labels[labelNetSetNamespace]
+		if namespace != "" && !e.namespaceExists(namespace) {
+			namespace = ""
+		}
+		if namespace == "" {
+			namespace = e.fallbackNamespace
+		}
+	}
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	return &v1.ObjectReference{
+		APIVersion: "projectcalico.org/v3",
+		Kind:       "GlobalNetworkSet",
+		Name:       id,
+		Namespace:  namespace,
+	}
+}
+
+// namespaceExists returns whether a local namespace exists. Failed lookups
+// assume it does, to keep the events of the remote namespace together.
+func (e *setEvents) namespaceExists(namespace string) bool {
+	if e.client == nil {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if l, ok := e.namespaces[namespace]; ok && time.Since(l.at) < namespaceLookupTTL {
+		return l.exists
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := e.client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	exists := err == nil || !errors.IsNotFound(err)
+	if err != nil && exists {
+		log.Store.Warn("Cannot look up local namespace for events", "namespace", namespace, "err", err)
+	}
+	if e.namespaces == nil {
+		e.namespaces = make(map[string]namespaceLookup)
+	}
+	e.namespaces[namespace] = namespaceLookup{exists: exists, at: time.Now()}
+	return exists
+}
+
+// synced records an event for a change applied to a set
+func (e *setEvents) synced(id string, action calico.Action, labels map[string]string, nets int) {
+	if e == nil || action == calico.ActionNone {
+		return
+	}
+	message := fmt.Sprintf("%s GlobalNetworkSet %s for %s with %d nets", action, id, describeSet(labels), nets)
+	if action == calico.ActionDeleted {
+		message = fmt.Sprintf("Deleted GlobalNetworkSet %s for %s", id, describeSet(labels))
+	}
+	e.recorder.AnnotatedEventf(e.reference(id, labels), eventAnnotations(labels), v1.EventTypeNormal, string(action), "%s", message)
+}
+
+// syncFailed records an event for a set that repeatedly fails to sync
+func (e *setEvents) syncFailed(id string, labels map[string]string, failures int, err error) {
+	if e == nil {
+		return
+	}
+	e.recorder.AnnotatedEventf(e.reference(id, labels), eventAnnotations(labels), v1.EventTypeWarning, "SyncFailed",
+		"Failed to sync GlobalNetworkSet %s for %s %d times in a row: %v", id, describeSet(labels), failures, err)
+}
+
+// describeSet returns a description of the remote pods in a set
+func describeSet(labels map[string]string) string {
+	if labels[labelNetSetScope] == valueScopeNamespace {
+		return fmt.Sprintf("all pods of namespace %s in cluster %s", labels[labelNetSetNamespace], labels[labelNetSetCluster])
+	}
+	return fmt.Sprintf("pods labelled %s=%s in namespace %s of cluster %s", labelNetSetName, labels[labelNetSetName], labels[labelNetSetNamespace], labels[labelNetSetCluster])
+}
+
+// eventAnnotations returns the remote cluster, namespace and name of a set
+func eventAnnotations(labels map[string]string) map[string]string {
+	annotations := make(map[string]string)
+	for _, k := range []string{labelNetSetCluster, labelNetSetNamespace, labelNetSetName} {
+		if v, ok := labels[k]; ok {
+			annotations[k] = v
+		}
+	}
+	return annotations
+}
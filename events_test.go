@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/utilitywarehouse/semaphore-policy/audit"
+	"github.com/utilitywarehouse/semaphore-policy/calico"
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+func TestSetEvents(t *testing.T) {
+	log.InitLogger("test", "debug")
+	recorder := record.NewFakeRecorder(10)
+	nss := &NetworkSetStore{
+		store:   make(map[string]*NetworkSet),
+		cluster: "test",
+		events:  &setEvents{recorder: recorder},
+	}
+	nss.AddNet("name", "namespace", "10.0.0.1/32", "pod", audit.ReasonAdd)
+	id := makeNetworkSetID("name", "namespace", "test")
+	labels, _, _ := nss.get(id)
+
+	nss.synced(id, calico.ActionCreated, labels, []string{"10.0.0.1/32"})
+	assert.Contains(t, <-recorder.Events, "Normal Created Created GlobalNetworkSet test-namespace-name for pods labelled policy.semaphore.uw.io/name=name in namespace namespace of cluster test with 1 nets")
+
+	// Unchanged sets do not record events
+	nss.synced(id, calico.ActionNone, labels, []string{"10.0.0.1/32"})
+	assert.Equal(t, 0, len(recorder.Events))
+
+	// Failures are only reported once repeated
+	for i := 0; i < syncFailureEventThreshold; i++ {
+		nss.syncFailed(id, fmt.Errorf("boom"))
+	}
+	assert.Equal(t, 1, len(recorder.Events))
+	assert.Contains(t, <-recorder.Events, "Warning SyncFailed Failed to sync GlobalNetworkSet test-namespace-name")
+
+	// Deleting the set reports its last known labels
+	nss.DeleteNet("name", "namespace", "10.0.0.1/32", audit.ReasonDelete)
+	nss.synced(id, calico.ActionDeleted, nil, nil)
+	assert.Contains(t, <-recorder.Events, "Normal Deleted Deleted GlobalNetworkSet test-namespace-name for pods labelled policy.semaphore.uw.io/name=name in namespace namespace of cluster test")
+	// and sets that were not known to exist are not reported
+	nss.synced(id, calico.ActionDeleted, nil, nil)
+	assert.Equal(t, 0, len(recorder.Events))
+}
+
+func TestSetEventsNamespace(t *testing.T) {
+	labels := map[string]string{labelNetSetNamespace: "remote"}
+	e := &setEvents{}
+	assert.Equal(t, "remote", e.reference("id", labels).Namespace)
+	assert.Equal(t, "default", e.reference("id", nil).Namespace)
+	e.namespace = "events"
+	assert.Equal(t, "events", e.reference("id", labels).Namespace)
+
+	// Remote namespaces missing locally fall back to the operator namespace
+	client := fake.NewSimpleClientset(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "remote"}})
+	e = &setEvents{client: client, fallbackNamespace: "operator"}
+	assert.Equal(t, "remote", e.reference("id", labels).Namespace)
+	assert.Equal(t, "operator", e.reference("id", map[string]string{labelNetSetNamespace: "missing"}).Namespace)
+	assert.Equal(t, "operator", e.reference("id", nil).Namespace)
+	// and lookups are cached
+	assert.NoError(t, client.CoreV1().Namespaces().Delete(context.Background(), "remote", metav1.DeleteOptions{}))
+	assert.Equal(t, "remote", e.reference("id", labels).Namespace)
+	e.namespaces["remote"] = namespaceLookup{exists: true, at: time.Now().Add(-namespaceLookupTTL)}
+	assert.Equal(t, "operator", e.reference("id", labels).Namespace)
+}
@@ -0,0 +1,324 @@
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/utilitywarehouse/semaphore-policy/log"
+	"github.com/utilitywarehouse/semaphore-policy/metrics"
+)
+
+// Environment variables passed to the hook command
+const (
+	EnvDir     = "SP_EXPORT_DIR"
+	EnvFormat  = "SP_EXPORT_FORMAT"
+	EnvChanged = "SP_EXPORT_CHANGED"
+	EnvRemoved = "SP_EXPORT_REMOVED"
+)
+
+// manifestName is the name of the file that lists the files written by the
+// exporter, which are the only ones it removes
+const manifestName = ".semaphore-policy-export.json"
+
+// manifest is the content of the manifest file
+type manifest struct {
+	Files []string `json:"files"`
+}
+
+// Set is a network set to export
+type Set struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Nets   []string          `json:"nets"`
+}
+
+// Exporter writes the sets to a directory, one file per set, replacing the
+// files atomically. An optional hook command runs after the files change.
+type Exporter struct {
+	dir         string
+	format      Format
+	hook        string
+	hookTimeout time.Duration
+
+	mu sync.Mutex
+	// owned holds the names of the files written by the exporter, as listed
+	// in the manifest
+	owned map[string]bool
+	// changed and removed hold the sets written and removed since the last
+	// run of the hook
+	changed map[string]bool
+	removed map[string]bool
+	pending chan struct{}
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// New returns an Exporter that writes the sets to dir in format. hook is run
+// with sh -c, if not empty, and killed after hookTimeout.
+func New(dir string, format Format, hook string, hookTimeout time.Duration) (*Exporter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create export directory: %v", err)
+	}
+	owned, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{
+		dir:         dir,
+		format:      format,
+		hook:        hook,
+		hookTimeout: hookTimeout,
+		owned:       owned,
+		changed:     make(map[string]bool),
+		removed:     make(map[string]bool),
+		pending:     make(chan struct{}, 1),
+	}, nil
+}
+
+// readManifest returns the files listed in the manifest of dir, if any
+func readManifest(dir string) (map[string]bool, error) {
+	owned := make(map[string]bool)
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return owned, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read export manifest: %v", err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("cannot parse export manifest: %v", err)
+	}
+	for _, f := range m.Files {
+		// only plain file names are expected, anything else is not ours
+		if f == filepath.Base(f) && f != manifestName {
+			owned[f] = true
+		}
+	}
+	return owned, nil
+}
+
+// saveManifest records the files owned by the exporter. It must be called
+// with the lock held.
+func (e *Exporter) saveManifest() error {
+	data, err := json.MarshalIndent(manifest{Files: sortedKeys(e.owned)}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(e.dir, manifestName), append(data, '\n'))
+}
+
+// Sync writes all the sets and removes the files written for the sets not
+// among them, including the ones of a previous format. Files the exporter did
+// not write are left alone.
+func (e *Exporter) Sync(sets []Set) error {
+	var errs []string
+	files := make(map[string]bool, len(sets))
+	for _, s := range sets {
+		files[filepath.Base(e.path(s.Name))] = true
+		if err := e.Write(s); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	e.mu.Lock()
+	owned := sortedKeys(e.owned)
+	e.mu.Unlock()
+	for _, f := range owned {
+		if !files[f] {
+			if err := e.remove(f, strings.TrimSuffix(f, filepath.Ext(f))); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Write replaces the file of a set with its current nets
+func (e *Exporter) Write(s Set) error {
+	data, err := e.format.render(s)
+	if err != nil {
+		return e.failed("write", s.Name, err)
+	}
+	if err := writeFile(e.path(s.Name), data); err != nil {
+		return e.failed("write", s.Name, err)
+	}
+	log.Store.Debug("Exported network set", "resource", s.Name, "path", e.path(s.Name), "nets", len(s.Nets))
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.changed[s.Name] = true
+	delete(e.removed, s.Name)
+	if file := filepath.Base(e.path(s.Name)); !e.owned[file] {
+		e.owned[file] = true
+		if err := e.saveManifest(); err != nil {
+			return e.failed("write", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// Remove removes the file of a set, if written by the exporter
+func (e *Exporter) Remove(name string) error {
+	return e.remove(filepath.Base(e.path(name)), name)
+}
+
+// remove removes a file of the set name, if written by the exporter
+func (e *Exporter) remove(file, name string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.owned[file] {
+		path := filepath.Join(e.dir, file)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return e.failed("remove", name, err)
+		}
+		log.Store.Debug("Removed exported network set", "resource", name, "path", path)
+		delete(e.owned, file)
+		if err := e.saveManifest(); err != nil {
+			return e.failed("remove", name, err)
+		}
+	}
+	e.removed[name] = true
+	delete(e.changed, name)
+	return nil
+}
+
+func (e *Exporter) failed(op, name string, err error) error {
+	metrics.IncExportErrors(op)
+	return fmt.Errorf("cannot %s exported set %s: %v", op, name, err)
+}
+
+func (e *Exporter) path(name string) string {
+	return filepath.Join(e.dir, name+e.format.Ext())
+}
+
+// writeFile writes data to a temporary file in the directory of path and
+// renames it over path, so that readers see either the old or the new file
+func writeFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Changed schedules a run of the hook for the files changed so far. Runs are
+// not concurrent, and the changes made while the hook runs are batched into
+// the next run.
+func (e *Exporter) Changed() {
+	if e.hook == "" {
+		return
+	}
+	select {
+	case e.pending <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts running the hook on changes
+func (e *Exporter) Start() {
+	if e.hook == "" {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	e.done = make(chan struct{})
+	go func() {
+		defer close(e.done)
+		for {
+			select {
+			case <-e.pending:
+				e.runHook(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops running the hook, killing a running one
+func (e *Exporter) Stop() {
+	if e.cancel == nil {
+		return
+	}
+	e.cancel()
+	<-e.done
+}
+
+func (e *Exporter) runHook(ctx context.Context) {
+	e.mu.Lock()
+	changed, removed := sortedKeys(e.changed), sortedKeys(e.removed)
+	e.changed = make(map[string]bool)
+	e.removed = make(map[string]bool)
+	e.mu.Unlock()
+	if len(changed) == 0 && len(removed) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", e.hook)
+	cmd.Dir = e.dir
+	cmd.Env = append(os.Environ(),
+		EnvDir+"="+e.dir,
+		EnvFormat+"="+string(e.format),
+		EnvChanged+"="+strings.Join(changed, " "),
+		EnvRemoved+"="+strings.Join(removed, " "),
+	)
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		metrics.IncExportErrors("hook")
+		log.Store.Error("Export hook failed", "changed", changed, "removed", removed, "output", string(out), "err", err)
+		// the failed changes are passed on to the next run, unless
+		// superseded meanwhile
+		e.mu.Lock()
+		for _, name := range changed {
+			if !e.removed[name] {
+				e.changed[name] = true
+			}
+		}
+		for _, name := range removed {
+			if !e.changed[name] {
+				e.removed[name] = true
+			}
+		}
+		e.mu.Unlock()
+		return
+	}
+	log.Store.Debug("Export hook ran", "changed", changed, "removed", removed, "duration", time.Since(start), "output", string(out))
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,168 @@
+package export
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+var testSet = Set{
+	Name:   "remote-example-app",
+	Labels: map[string]string{"app": "example"},
+	Nets:   []string{"10.0.0.1/32", "10.0.0.2/32", "fd00::1/128"},
+}
+
+func TestParseFormat(t *testing.T) {
+	f, err := ParseFormat("nftables")
+	assert.NoError(t, err)
+	assert.Equal(t, FormatNFTables, f)
+	_, err = ParseFormat("iptables")
+	assert.Error(t, err)
+}
+
+func TestRender(t *testing.T) {
+	data, err := FormatCIDR.render(testSet)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1/32\n10.0.0.2/32\nfd00::1/128\n", string(data))
+
+	data, err = FormatJSON.render(testSet)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"name": "remote-example-app"`)
+
+	data, err = FormatIPSet.render(testSet)
+	assert.NoError(t, err)
+	assert.Equal(t, `create remote-example-app hash:net family inet -exist
+create remote-example-app-t hash:net family inet -exist
+flush remote-example-app-t
+add remote-example-app-t 10.0.0.1/32
+add remote-example-app-t 10.0.0.2/32
+swap remote-example-app-t remote-example-app
+destroy remote-example-app-t
+create remote-example-app-v6 hash:net family inet6 -exist
+create remote-example-app-v6-t hash:net family inet6 -exist
+flush remote-example-app-v6-t
+add remote-example-app-v6-t fd00::1/128
+swap remote-example-app-v6-t remote-example-app-v6
+destroy remote-example-app-v6-t
+`, string(data))
+
+	data, err = FormatNFTables.render(Set{Name: "remote.example", Nets: []string{"10.0.0.1/32", "10.0.0.2/32"}})
+	assert.NoError(t, err)
+	name := NFTablesSetName("remote.example")
+	assert.Equal(t, `table inet semaphore_policy {
+	set `+name+`_v4 {
+		type ipv4_addr
+		flags interval
+	}
+	set `+name+`_v6 {
+		type ipv6_addr
+		flags interval
+	}
+}
+flush set inet semaphore_policy `+name+`_v4
+add element inet semaphore_policy `+name+`_v4 { 10.0.0.1/32, 10.0.0.2/32 }
+flush set inet semaphore_policy `+name+`_v6
+`, string(data))
+}
+
+func TestNFTablesSetName(t *testing.T) {
+	identifier := regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+	// Set ids of namespace sets hold dots, the others dashes, and cluster
+	// names may start with a digit
+	for _, name := range []string{"remote.example", "remote-example-app", "1remote-example-app", "remote_app"} {
+		assert.Regexp(t, identifier, NFTablesSetName(name), name)
+	}
+	assert.Equal(t, "set_remote_app", NFTablesSetName("remote_app"))
+	assert.True(t, strings.HasPrefix(NFTablesSetName("remote.example"), "set_remote_example_"))
+	assert.NotEqual(t, NFTablesSetName("remote.example"), NFTablesSetName("remote-example"))
+	long := NFTablesSetName(strings.Repeat("a", 300))
+	assert.Equal(t, nftablesMaxBase, len(long))
+}
+
+func TestIPSetName(t *testing.T) {
+	assert.Equal(t, "remote-example-app", IPSetName("remote-example-app"))
+	long := IPSetName("remote-a-very-long-namespace-name-app")
+	assert.Equal(t, ipsetMaxBase, len(long))
+	assert.True(t, strings.HasPrefix(long, "remote-a-very-l-"))
+	assert.NotEqual(t, long, IPSetName("remote-a-very-long-namespace-name-api"))
+}
+
+func TestExporterSync(t *testing.T) {
+	log.InitLogger("test", "debug")
+	dir := t.TempDir()
+	// files the exporter did not write are left alone
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "other.txt"), []byte("10.0.0.9/32\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "notes.json"), []byte("{}"), 0644))
+	e, err := New(dir, FormatJSON, "", time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, e.Sync([]Set{{Name: "stale"}}))
+
+	// the files written by a previous run are removed, whatever their
+	// format
+	e, err = New(dir, FormatCIDR, "", time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, e.Sync([]Set{testSet}))
+	data, err := os.ReadFile(filepath.Join(dir, "remote-example-app.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1/32\n10.0.0.2/32\nfd00::1/128\n", string(data))
+	_, err = os.Stat(filepath.Join(dir, "stale.json"))
+	assert.True(t, os.IsNotExist(err))
+	for _, f := range []string{"other.txt", "notes.json"} {
+		_, err = os.Stat(filepath.Join(dir, f))
+		assert.NoError(t, err, f)
+	}
+
+	assert.NoError(t, e.Remove("remote-example-app"))
+	assert.NoError(t, e.Remove("other"))
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{manifestName, "notes.json", "other.txt"}, names, "no temporary files are left behind")
+	data, err = os.ReadFile(filepath.Join(dir, manifestName))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"files":[]}`, string(data))
+}
+
+func TestExporterHook(t *testing.T) {
+	log.InitLogger("test", "debug")
+	dir := t.TempDir()
+	out := filepath.Join(t.TempDir(), "hook")
+	hook := `echo "$SP_EXPORT_FORMAT:$SP_EXPORT_CHANGED:$SP_EXPORT_REMOVED" >> ` + out + ` && test -f "$SP_EXPORT_DIR/a.json"`
+	e, err := New(dir, FormatJSON, hook, time.Minute)
+	assert.NoError(t, err)
+	e.Start()
+	defer e.Stop()
+
+	assert.NoError(t, e.Write(Set{Name: "a", Nets: []string{"10.0.0.1/32"}}))
+	assert.NoError(t, e.Write(Set{Name: "b", Nets: []string{"10.0.0.2/32"}}))
+	assert.NoError(t, e.Remove("c"))
+	e.Changed()
+	assert.Eventually(t, func() bool {
+		data, _ := os.ReadFile(out)
+		return string(data) == "json:a b:c\n"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a failed run passes its changes on to the next one
+	assert.NoError(t, e.Remove("a"))
+	e.Changed()
+	assert.Eventually(t, func() bool {
+		data, _ := os.ReadFile(out)
+		return string(data) == "json:a b:c\njson::a\n"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, e.Write(Set{Name: "b", Nets: []string{"10.0.0.3/32"}}))
+	e.Changed()
+	assert.Eventually(t, func() bool {
+		data, _ := os.ReadFile(out)
+		return string(data) == "json:a b:c\njson::a\njson:b:a\n"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,191 @@
+package export
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Format is the format of the exported files
+type Format string
+
+const (
+	// FormatCIDR is a plain-text list of nets, one per line
+	FormatCIDR Format = "cidr"
+	// FormatJSON is a JSON document with the name, labels and nets of a set
+	FormatJSON Format = "json"
+	// FormatIPSet is a script for `ipset restore` that swaps the nets into
+	// an ipv4 and an ipv6 set
+	FormatIPSet Format = "ipset"
+	// FormatNFTables is a script for `nft -f` that replaces the elements of
+	// an ipv4 and an ipv6 set of the NFTablesTable table
+	FormatNFTables Format = "nftables"
+)
+
+// NFTablesTable is the inet table that holds the nftables sets
+const NFTablesTable = "semaphore_policy"
+
+// ipsetMaxBase is the length of the ipset names the set names are shortened
+// to, leaving room for the suffixes within the 31 characters allowed
+const ipsetMaxBase = 24
+
+// nftablesMaxBase is the length of the nftables names the set names are
+// shortened to, leaving room for the suffixes within the 255 characters
+// allowed
+const nftablesMaxBase = 248
+
+// ParseFormat returns the format named s
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatCIDR, FormatJSON, FormatIPSet, FormatNFTables:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown export format %q, expected cidr, json, ipset or nftables", s)
+}
+
+// Ext returns the extension of the files of the format
+func (f Format) Ext() string {
+	switch f {
+	case FormatCIDR:
+		return ".txt"
+	case FormatJSON:
+		return ".json"
+	case FormatIPSet:
+		return ".ipset"
+	case FormatNFTables:
+		return ".nft"
+	}
+	return ""
+}
+
+// render returns the content of the file of a set
+func (f Format) render(s Set) ([]byte, error) {
+	switch f {
+	case FormatCIDR:
+		return renderCIDR(s), nil
+	case FormatJSON:
+		data, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	case FormatIPSet:
+		return renderIPSet(s), nil
+	case FormatNFTables:
+		return renderNFTables(s), nil
+	}
+	return nil, fmt.Errorf("unknown export format %q", f)
+}
+
+func renderCIDR(s Set) []byte {
+	var b bytes.Buffer
+	for _, net := range s.Nets {
+		fmt.Fprintln(&b, net)
+	}
+	return b.Bytes()
+}
+
+// renderIPSet fills temporary sets and swaps them with the live ones, so that
+// the live sets are never seen partially filled
+func renderIPSet(s Set) []byte {
+	v4, v6 := splitFamilies(s.Nets)
+	name := IPSetName(s.Name)
+	var b bytes.Buffer
+	for _, family := range []struct {
+		name, family string
+		nets         []string
+	}{
+		{name, "inet", v4},
+		{name + "-v6", "inet6", v6},
+	} {
+		tmp := family.name + "-t"
+		fmt.Fprintf(&b, "create %s hash:net family %s -exist\n", family.name, family.family)
+		fmt.Fprintf(&b, "create %s hash:net family %s -exist\n", tmp, family.family)
+		fmt.Fprintf(&b, "flush %s\n", tmp)
+		for _, net := range family.nets {
+			fmt.Fprintf(&b, "add %s %s\n", tmp, net)
+		}
+		fmt.Fprintf(&b, "swap %s %s\n", tmp, family.name)
+		fmt.Fprintf(&b, "destroy %s\n", tmp)
+	}
+	return b.Bytes()
+}
+
+// renderNFTables declares the sets and replaces their elements, which nft
+// applies in a single transaction
+func renderNFTables(s Set) []byte {
+	v4, v6 := splitFamilies(s.Nets)
+	name := NFTablesSetName(s.Name)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "table inet %s {\n", NFTablesTable)
+	fmt.Fprintf(&b, "\tset %s_v4 {\n\t\ttype ipv4_addr\n\t\tflags interval\n\t}\n", name)
+	fmt.Fprintf(&b, "\tset %s_v6 {\n\t\ttype ipv6_addr\n\t\tflags interval\n\t}\n", name)
+	fmt.Fprintf(&b, "}\n")
+	for _, family := range []struct {
+		name string
+		nets []string
+	}{
+		{name + "_v4", v4},
+		{name + "_v6", v6},
+	} {
+		fmt.Fprintf(&b, "flush set inet %s %s\n", NFTablesTable, family.name)
+		if len(family.nets) > 0 {
+			fmt.Fprintf(&b, "add element inet %s %s { %s }\n", NFTablesTable, family.name, strings.Join(family.nets, ", "))
+		}
+	}
+	return b.Bytes()
+}
+
+// IPSetName returns the name of the ipv4 ipset of a set, shortened with a hash
+// of the name if too long. The ipv6 ipset is suffixed with -v6.
+func IPSetName(name string) string {
+	if len(name) <= ipsetMaxBase {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return name[:ipsetMaxBase-9] + "-" + hex.EncodeToString(sum[:4])
+}
+
+// NFTablesSetName returns the base name of the nftables sets of a set, which
+// are suffixed with _v4 and _v6. nft identifiers must start with a letter and
+// cannot contain dashes, so names are prefixed with set_ and characters other
+// than letters, digits and underscores are replaced with underscores. A hash
+// of the name is appended when any is replaced, or the name is shortened, to
+// keep the names distinct.
+func NFTablesSetName(name string) string {
+	base := "set_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	if base == "set_"+name && len(base) <= nftablesMaxBase {
+		return base
+	}
+	if len(base) > nftablesMaxBase-9 {
+		base = base[:nftablesMaxBase-9]
+	}
+	sum := sha256.Sum256([]byte(name))
+	return base + "_" + hex.EncodeToString(sum[:4])
+}
+
+// splitFamilies splits nets into ipv4 and ipv6 ones
+func splitFamilies(nets []string) ([]string, []string) {
+	var v4, v6 []string
+	for _, n := range nets {
+		ip, _, err := net.ParseCIDR(n)
+		if err != nil {
+			ip = net.ParseIP(n)
+		}
+		if ip != nil && ip.To4() == nil {
+			v6 = append(v6, n)
+		} else {
+			v4 = append(v4, n)
+		}
+	}
+	return v4, v6
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/utilitywarehouse/semaphore-policy/export"
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+// runExport exports the sets of the feed to files until stop is closed. It
+// waits for a successful full sync, so that the files left by a previous run
+// are not removed before all the sets are known, and then watches the feed
+// like the api clients do, starting over from a new snapshot if it falls
+// behind. Sets that fail to sync keep their last synced state in the feed, so
+// their files are only removed once the sets are deleted.
+func runExport(f *setFeed, e *export.Exporter, stop <-chan struct{}) {
+	select {
+	case <-f.ready:
+	case <-stop:
+		return
+	}
+	for {
+		snapshot, w := f.subscribe(labels.Everything())
+		sets := make([]export.Set, 0, len(snapshot.Sets))
+		for _, s := range snapshot.Sets {
+			sets = append(sets, exportSet(s))
+		}
+		if err := e.Sync(sets); err != nil {
+			log.Store.Error("Failed to export network sets", "err", err)
+		}
+		e.Changed()
+		if !exportChanges(w, e, stop) {
+			f.stop(w)
+			return
+		}
+		log.Store.Warn("Export fell behind the network sets, exporting them all again")
+	}
+}
+
+// exportChanges applies the changes received by the watcher to the files,
+// running the hook after each batch of them. It returns false once stop is
+// closed, and true if the watcher was dropped.
+func exportChanges(w *setWatcher, e *export.Exporter, stop <-chan struct{}) bool {
+	for {
+		select {
+		case c := <-w.events:
+			exportChange(e, c)
+			// batch up the changes already waiting
+			for len(w.events) > 0 {
+				exportChange(e, <-w.events)
+			}
+			e.Changed()
+		case <-w.closed:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+}
+
+func exportChange(e *export.Exporter, c setChange) {
+	var err error
+	if c.next != nil {
+		err = e.Write(exportSet(*c.next))
+	} else {
+		err = e.Remove(c.prev.ID)
+	}
+	if err != nil {
+		log.Store.Error("Failed to export network set", "err", err)
+	}
+}
+
+func exportSet(s SetState) export.Set {
+	return export.Set{Name: s.ID, Labels: s.Labels, Nets: s.Nets}
+}
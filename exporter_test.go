@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/utilitywarehouse/semaphore-policy/audit"
+	"github.com/utilitywarehouse/semaphore-policy/export"
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+func TestRunExport(t *testing.T) {
+	log.InitLogger("test", "debug")
+	dir := t.TempDir()
+	// a file left by a previous run is kept until a successful full sync
+	e, err := export.New(dir, export.FormatCIDR, "", time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, e.Write(export.Set{Name: "gone", Nets: []string{"10.0.0.9/32"}}))
+	e, err = export.New(dir, export.FormatCIDR, "", time.Minute)
+	assert.NoError(t, err)
+	f := newSetFeed()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runExport(f, e, stop)
+		close(done)
+	}()
+	read := func(name string) string {
+		data, _ := os.ReadFile(filepath.Join(dir, name))
+		return string(data)
+	}
+
+	f.update("a", nil, []string{"10.0.0.1/32"})
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, "10.0.0.9/32\n", read("gone.txt"))
+	f.markReady()
+	assert.Eventually(t, func() bool { return read("a.txt") == "10.0.0.1/32\n" }, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool { return read("gone.txt") == "" }, time.Second, time.Millisecond)
+
+	f.update("a", nil, []string{"10.0.0.1/32", "10.0.0.2/32"})
+	assert.Eventually(t, func() bool { return read("a.txt") == "10.0.0.1/32\n10.0.0.2/32\n" }, time.Second, time.Millisecond)
+	f.delete("a")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, "a.txt"))
+		return os.IsNotExist(err)
+	}, time.Second, time.Millisecond)
+
+	close(stop)
+	<-done
+	f.mu.Lock()
+	assert.Equal(t, 0, len(f.watchers))
+	f.mu.Unlock()
+}
+
+func TestRunExportWaitsForSuccessfulFullSync(t *testing.T) {
+	log.InitLogger("test", "debug")
+	dir := t.TempDir()
+	e, err := export.New(dir, export.FormatCIDR, "", time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, e.Write(export.Set{Name: "test-namespace-old", Nets: []string{"10.0.0.9/32"}}))
+	e, err = export.New(dir, export.FormatCIDR, "", time.Minute)
+	assert.NoError(t, err)
+	fc, client := newFakeCalico(t)
+	nss := newNetworkSetStore("test", client)
+	nss.AddNet("name", "namespace", "10.0.0.1/32", "pod-1", audit.ReasonAdd)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runExport(nss.feed, e, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	// A full sync failing, e.g. while calico is down, leaves the files of
+	// the previous run alone
+	fc.setFailing(true)
+	nss.fullSync()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-nss.feed.ready:
+		t.Fatal("feed ready after a failed full sync")
+	default:
+	}
+	_, err = os.Stat(filepath.Join(dir, "test-namespace-old.txt"))
+	assert.NoError(t, err)
+
+	fc.setFailing(false)
+	nss.fullSync()
+	assert.Eventually(t, func() bool {
+		data, _ := os.ReadFile(filepath.Join(dir, "test-namespace-name.txt"))
+		return string(data) == "10.0.0.1/32\n"
+	}, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, "test-namespace-old.txt"))
+		return os.IsNotExist(err)
+	}, time.Second, time.Millisecond)
+}
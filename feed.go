@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/utilitywarehouse/semaphore-policy/log"
+	"github.com/utilitywarehouse/semaphore-policy/metrics"
+)
+
+const (
+	// watchBufferSize is the number of events a watcher can fall behind by
+	// before it is disconnected
+	watchBufferSize = 256
+	// watchBookmarkInterval is the interval of the bookmarks sent to idle
+	// watchers, to keep the stream alive through proxies
+	watchBookmarkInterval = 30 * time.Second
+)
+
+// Types of the watch events
+const (
+	WatchSnapshot = "snapshot"
+	WatchAdded    = "added"
+	WatchUpdated  = "updated"
+	WatchDeleted  = "deleted"
+	WatchBookmark = "bookmark"
+	WatchError    = "error"
+)
+
+// SetState is the state of a set as applied to calico
+type SetState struct {
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels"`
+	Nets   []string          `json:"nets"`
+}
+
+// SetList is a consistent snapshot of the sets at a revision
+type SetList struct {
+	Revision uint64     `json:"revision"`
+	Sets     []SetState `json:"sets"`
+}
+
+// WatchEvent is a line of the watch stream. A snapshot carries the sets at the
+// revision, the other changes carry the set they apply to, with the nets
+// added to and removed from it.
+type WatchEvent struct {
+	Type     string     `json:"type"`
+	Revision uint64     `json:"revision"`
+	Sets     []SetState `json:"sets,omitempty"`
+	Set      *SetState  `json:"set,omitempty"`
+	Added    []string   `json:"added,omitempty"`
+	Removed  []string   `json:"removed,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// setChange is a change of a set broadcast to the watchers, which filter it
+// by their selector. prev is nil for new sets and next for deleted ones.
+type setChange struct {
+	revision   uint64
+	prev, next *SetState
+}
+
+// setFeed keeps the state of the sets applied to calico and streams its
+// changes to watchers. Every change bumps the revision of the feed.
+type setFeed struct {
+	mu       sync.Mutex
+	revision uint64
+	sets     map[string]*SetState
+	watchers map[*setWatcher]struct{}
+	// ready is closed once a full sync has synced all the sets without
+	// errors
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+type setWatcher struct {
+	selector labels.Selector
+	events   chan setChange
+	// closed is closed when the watcher falls behind and is dropped
+	closed chan struct{}
+}
+
+func newSetFeed() *setFeed {
+	return &setFeed{
+		sets:     make(map[string]*SetState),
+		watchers: make(map[*setWatcher]struct{}),
+		ready:    make(chan struct{}),
+	}
+}
+
+// markReady records that the feed holds all the sets, after a successful full
+// sync
+func (f *setFeed) markReady() {
+	if f == nil {
+		return
+	}
+	f.readyOnce.Do(func() { close(f.ready) })
+}
+
+// isReady returns true once the feed holds all the sets
+func (f *setFeed) isReady() bool {
+	select {
+	case <-f.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// errNotReady is served until the first successful full sync, as the sets are
+// missing or partial until then and clients would take them as complete
+var errNotReady = map[string]string{"error": "network sets not synced yet, try again later"}
+
+// update records the labels and nets of a set synced to calico, if they
+// changed
+func (f *setFeed) update(id string, labels map[string]string, nets []string) {
+	if f == nil {
+		return
+	}
+	next := &SetState{ID: id, Labels: copyLabels(labels), Nets: append([]string{}, nets...)}
+	sort.Strings(next.Nets)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	prev := f.sets[id]
+	if prev != nil && equalLabels(prev.Labels, next.Labels) && equalNets(prev.Nets, next.Nets) {
+		return
+	}
+	f.sets[id] = next
+	f.broadcast(prev, next)
+}
+
+// delete records a set deleted from calico
+func (f *setFeed) delete(id string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	prev, ok := f.sets[id]
+	if !ok {
+		return
+	}
+	delete(f.sets, id)
+	f.broadcast(prev, nil)
+}
+
+// broadcast bumps the revision and sends a change to the watchers, dropping
+// the ones that fell behind. It must be called with the lock held.
+func (f *setFeed) broadcast(prev, next *SetState) {
+	f.revision++
+	c := setChange{revision: f.revision, prev: prev, next: next}
+	for w := range f.watchers {
+		select {
+		case w.events <- c:
+		default:
+			log.Store.Warn("Set watcher fell behind, dropping it", "revision", f.revision)
+			f.unsubscribe(w)
+			close(w.closed)
+		}
+	}
+}
+
+// list returns the sets matching the selector, sorted by id, and the revision
+// of the feed
+func (f *setFeed) list(selector labels.Selector) SetList {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.snapshot(selector)
+}
+
+// snapshot must be called with the lock held
+func (f *setFeed) snapshot(selector labels.Selector) SetList {
+	list := SetList{Revision: f.revision, Sets: []SetState{}}
+	for _, s := range f.sets {
+		if selector.Matches(labels.Set(s.Labels)) {
+			list.Sets = append(list.Sets, *s)
+		}
+	}
+	sort.Slice(list.Sets, func(i, j int) bool { return list.Sets[i].ID < list.Sets[j].ID })
+	return list
+}
+
+// subscribe returns a snapshot of the sets matching the selector and a
+// watcher that receives the changes made after it
+func (f *setFeed) subscribe(selector labels.Selector) (SetList, *setWatcher) {
+	w := &setWatcher{
+		selector: selector,
+		events:   make(chan setChange, watchBufferSize),
+		closed:   make(chan struct{}),
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.watchers[w] = struct{}{}
+	metrics.SetSetWatchers(len(f.watchers))
+	return f.snapshot(selector), w
+}
+
+// unsubscribe must be called with the lock held
+func (f *setFeed) unsubscribe(w *setWatcher) {
+	delete(f.watchers, w)
+	metrics.SetSetWatchers(len(f.watchers))
+}
+
+func (f *setFeed) stop(w *setWatcher) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unsubscribe(w)
+}
+
+// event turns a change into the event seen through the selector of the
+// watcher. Sets whose labels stop or start matching the selector are seen as
+// deleted and added respectively. It returns false if the change is not
+// visible to the watcher.
+func (w *setWatcher) event(c setChange) (WatchEvent, bool) {
+	matched := c.prev != nil && w.selector.Matches(labels.Set(c.prev.Labels))
+	matches := c.next != nil && w.selector.Matches(labels.Set(c.next.Labels))
+	e := WatchEvent{Revision: c.revision}
+	switch {
+	case matched && matches:
+		e.Type, e.Set = WatchUpdated, c.next
+		e.Added, e.Removed = diffNets(c.prev.Nets, c.next.Nets)
+	case matches:
+		e.Type, e.Set, e.Added = WatchAdded, c.next, c.next.Nets
+	case matched:
+		e.Type, e.Set, e.Removed = WatchDeleted, c.prev, c.prev.Nets
+	default:
+		return e, false
+	}
+	return e, true
+}
+
+// diffNets returns the nets of next missing from prev and the nets of prev
+// missing from next
+func diffNets(prev, next []string) ([]string, []string) {
+	var added, removed []string
+	for _, net := range next {
+		if _, found := inSlice(prev, net); !found {
+			added = append(added, net)
+		}
+	}
+	for _, net := range prev {
+		if _, found := inSlice(next, net); !found {
+			removed = append(removed, net)
+		}
+	}
+	return added, removed
+}
+
+func equalNets(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
+
+// parseSelector parses the label selector of a request, which selects
+// everything if empty
+func parseSelector(r *http.Request) (labels.Selector, error) {
+	selector, err := labels.Parse(r.URL.Query().Get("selector"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %v", err)
+	}
+	return selector, nil
+}
+
+// setListHandler serves the sets matching the selector as JSON
+func setListHandler(f *setFeed) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		selector, err := parseSelector(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if !f.isReady() {
+			writeJSON(w, http.StatusServiceUnavailable, errNotReady)
+			return
+		}
+		writeJSON(w, http.StatusOK, f.list(selector))
+	}
+}
+
+// setWatchHandler streams the sets matching the selector as JSON lines: a
+// snapshot, followed by the changes made after it. Watchers that fall behind
+// receive an error event and are disconnected, to start over with a new
+// snapshot.
+func setWatchHandler(f *setFeed) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		selector, err := parseSelector(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming is not supported"})
+			return
+		}
+		if !f.isReady() {
+			writeJSON(w, http.StatusServiceUnavailable, errNotReady)
+			return
+		}
+		snapshot, watcher := f.subscribe(selector)
+		defer f.stop(watcher)
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(w)
+		send := func(e WatchEvent) bool {
+			if err := enc.Encode(e); err != nil {
+				log.HTTP.Debug("Set watcher went away", "err", err)
+				return false
+			}
+			flusher.Flush()
+			return true
+		}
+		if !send(WatchEvent{Type: WatchSnapshot, Revision: snapshot.Revision, Sets: snapshot.Sets}) {
+			return
+		}
+		revision := snapshot.Revision
+		bookmarks := time.NewTicker(watchBookmarkInterval)
+		defer bookmarks.Stop()
+		for {
+			select {
+			case c := <-watcher.events:
+				revision = c.revision
+				if e, ok := watcher.event(c); ok && !send(e) {
+					return
+				}
+			case <-bookmarks.C:
+				if !send(WatchEvent{Type: WatchBookmark, Revision: revision}) {
+					return
+				}
+			case <-watcher.closed:
+				send(WatchEvent{Type: WatchError, Revision: revision, Error: "watcher fell behind, watch again"})
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/utilitywarehouse/semaphore-policy/calico"
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+func TestSetFeedList(t *testing.T) {
+	f := newSetFeed()
+	f.update("b", map[string]string{"app": "b"}, []string{"10.0.0.2/32", "10.0.0.1/32"})
+	f.update("a", map[string]string{"app": "a"}, []string{"10.0.0.3/32"})
+	assert.Equal(t, uint64(2), f.list(labels.Everything()).Revision)
+
+	// Unchanged sets do not bump the revision
+	f.update("b", map[string]string{"app": "b"}, []string{"10.0.0.1/32", "10.0.0.2/32"})
+	list := f.list(labels.Everything())
+	assert.Equal(t, uint64(2), list.Revision)
+	assert.Equal(t, []SetState{
+		{ID: "a", Labels: map[string]string{"app": "a"}, Nets: []string{"10.0.0.3/32"}},
+		{ID: "b", Labels: map[string]string{"app": "b"}, Nets: []string{"10.0.0.1/32", "10.0.0.2/32"}},
+	}, list.Sets)
+
+	selector, err := labels.Parse("app=b")
+	assert.NoError(t, err)
+	list = f.list(selector)
+	assert.Equal(t, 1, len(list.Sets))
+	assert.Equal(t, "b", list.Sets[0].ID)
+
+	f.delete("b")
+	f.delete("unknown")
+	list = f.list(labels.Everything())
+	assert.Equal(t, uint64(3), list.Revision)
+	assert.Equal(t, 1, len(list.Sets))
+}
+
+func TestSetWatcherEvents(t *testing.T) {
+	selector, err := labels.Parse("app in (a)")
+	assert.NoError(t, err)
+	w := &setWatcher{selector: selector}
+	a := &SetState{ID: "s", Labels: map[string]string{"app": "a"}, Nets: []string{"10.0.0.1/32", "10.0.0.2/32"}}
+	a2 := &SetState{ID: "s", Labels: map[string]string{"app": "a"}, Nets: []string{"10.0.0.2/32", "10.0.0.3/32"}}
+	b := &SetState{ID: "s", Labels: map[string]string{"app": "b"}, Nets: []string{"10.0.0.2/32"}}
+
+	e, ok := w.event(setChange{revision: 1, next: a})
+	assert.True(t, ok)
+	assert.Equal(t, WatchEvent{Type: WatchAdded, Revision: 1, Set: a, Added: a.Nets}, e)
+
+	e, ok = w.event(setChange{revision: 2, prev: a, next: a2})
+	assert.True(t, ok)
+	assert.Equal(t, WatchUpdated, e.Type)
+	assert.Equal(t, []string{"10.0.0.3/32"}, e.Added)
+	assert.Equal(t, []string{"10.0.0.1/32"}, e.Removed)
+
+	// Sets whose labels stop matching are seen as deleted
+	e, ok = w.event(setChange{revision: 3, prev: a2, next: b})
+	assert.True(t, ok)
+	assert.Equal(t, WatchEvent{Type: WatchDeleted, Revision: 3, Set: a2, Removed: a2.Nets}, e)
+
+	_, ok = w.event(setChange{revision: 4, prev: b})
+	assert.False(t, ok)
+}
+
+func TestSetWatchHandler(t *testing.T) {
+	log.InitLogger("test", "debug")
+	nss := &NetworkSetStore{
+		store:   make(map[string]*NetworkSet),
+		cluster: "test",
+		feed:    newSetFeed(),
+	}
+	id := makeNetworkSetID("name", "namespace", "test")
+	otherID := makeNetworkSetID("other", "namespace", "test")
+	setLabels := nss.netSetLabels("name", "namespace")
+	nss.synced(id, calico.ActionCreated, setLabels, []string{"10.0.0.1/32"})
+	nss.feed.markReady()
+
+	server := httptest.NewServer(setWatchHandler(nss.feed))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "?selector=" + labelNetSetName + "%3Dname")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	events := bufio.NewScanner(resp.Body)
+	next := func() WatchEvent {
+		if !events.Scan() {
+			t.Fatalf("watch stream ended: %v", events.Err())
+		}
+		var e WatchEvent
+		assert.NoError(t, json.Unmarshal(events.Bytes(), &e))
+		return e
+	}
+
+	e := next()
+	assert.Equal(t, WatchSnapshot, e.Type)
+	assert.Equal(t, uint64(1), e.Revision)
+	assert.Equal(t, []SetState{{ID: id, Labels: setLabels, Nets: []string{"10.0.0.1/32"}}}, e.Sets)
+
+	// Changes of sets that do not match the selector are left out
+	nss.synced(otherID, calico.ActionCreated, nss.netSetLabels("other", "namespace"), []string{"10.0.0.9/32"})
+	nss.synced(id, calico.ActionUpdated, setLabels, []string{"10.0.0.1/32", "10.0.0.2/32"})
+	e = next()
+	assert.Equal(t, WatchUpdated, e.Type)
+	assert.Equal(t, uint64(3), e.Revision)
+	assert.Equal(t, []string{"10.0.0.2/32"}, e.Added)
+	assert.Nil(t, e.Removed)
+
+	nss.synced(id, calico.ActionDeleted, nil, nil)
+	e = next()
+	assert.Equal(t, WatchDeleted, e.Type)
+	assert.Equal(t, uint64(4), e.Revision)
+	assert.Equal(t, []string{"10.0.0.1/32", "10.0.0.2/32"}, e.Removed)
+}
+
+func TestSetHandlersWaitForFullSync(t *testing.T) {
+	f := newSetFeed()
+	f.update("a", nil, []string{"10.0.0.1/32"})
+	for name, handler := range map[string]http.HandlerFunc{
+		"list":  setListHandler(f),
+		"watch": setWatchHandler(f),
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/sets", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code, name)
+		assert.NotContains(t, rec.Body.String(), "10.0.0.1/32", name)
+	}
+	f.markReady()
+	rec := httptest.NewRecorder()
+	setListHandler(f)(rec, httptest.NewRequest(http.MethodGet, "/api/v1/sets", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "10.0.0.1/32")
+}
+
+func TestSetWatchHandlerInvalidSelector(t *testing.T) {
+	rec := httptest.NewRecorder()
+	setListHandler(newSetFeed())(rec, httptest.NewRequest(http.MethodGet, "/api/v1/sets?selector=a%20in", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestSetFeedDropsSlowWatchers(t *testing.T) {
+	log.InitLogger("test", "debug")
+	f := newSetFeed()
+	_, w := f.subscribe(labels.Everything())
+	for i := 0; i <= watchBufferSize; i++ {
+		f.update("s", nil, []string{string(rune('a' + i%2))})
+	}
+	<-w.closed
+	f.mu.Lock()
+	assert.Equal(t, 0, len(f.watchers))
+	f.mu.Unlock()
+	// stopping a dropped watcher is a no-op
+	f.stop(w)
+}
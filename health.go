@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/utilitywarehouse/semaphore-policy/kube"
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+// HealthStatus is the readiness report of the runner
+type HealthStatus struct {
+	Ready    bool                 `json:"ready"`
+	Reasons  []string             `json:"reasons,omitempty"`
+	Watchers []kube.WatcherStatus `json:"watchers"`
+	SyncLoop SyncLoopStatus       `json:"syncLoop"`
+	Startup  StartupStatus        `json:"startup"`
+	// HeldDeletions is the number of removals held back by the deletion
+	// protection per set
+	HeldDeletions map[string]int `json:"heldDeletions,omitempty"`
+}
+
+// Readiness reports the runner as ready once all watchers have synced their
+// caches, as long as each watcher has seen activity within maxWatchStaleness
+// and the sync loop has not been stuck on a task for longer than maxSyncStall.
+// Zero durations disable the respective check.
+func (r *Runner) Readiness(maxWatchStaleness, maxSyncStall time.Duration) HealthStatus {
+	status := HealthStatus{
+		Watchers: r.watcherStatuses(),
+		SyncLoop: r.nsStore.SyncLoopStatus(),
+		Startup:  r.startup.status(),
+	}
+	if r.nsStore.protection != nil {
+		status.HeldDeletions = r.nsStore.protection.held()
+	}
+	if !r.canSync.Load() {
+		status.Reasons = append(status.Reasons, "initial sync in progress")
+		if status.Startup.Timeouts > 0 {
+			status.Reasons = append(status.Reasons, fmt.Sprintf("initial sync timed out %d times, retrying", status.Startup.Timeouts))
+		}
+	}
+	now := time.Now()
+	for _, w := range status.Watchers {
+		if !w.Synced {
+			status.Reasons = append(status.Reasons, fmt.Sprintf("%s: cache not synced", w.Name))
+			continue
+		}
+		if maxWatchStaleness > 0 && now.Sub(w.LastActivity) > maxWatchStaleness {
+			status.Reasons = append(status.Reasons, fmt.Sprintf("%s: no watch activity since %s", w.Name, w.LastActivity.Format(time.RFC3339)))
+		}
+	}
+	if maxSyncStall > 0 && status.SyncLoop.Busy && now.Sub(status.SyncLoop.BusySince) > maxSyncStall {
+		status.Reasons = append(status.Reasons, fmt.Sprintf("sync loop stuck since %s", status.SyncLoop.BusySince.Format(time.RFC3339)))
+	}
+	status.Ready = len(status.Reasons) == 0
+	return status
+}
+
+func (r *Runner) watcherStatuses() []kube.WatcherStatus {
+	var statuses []kube.WatcherStatus
+	for _, pw := range r.podWatchers {
+		statuses = append(statuses, pw.Status())
+	}
+	if r.namespaceWatcher != nil {
+		statuses = append(statuses, r.namespaceWatcher.Status())
+	}
+	if r.namespaceLabelsWatcher != nil {
+		statuses = append(statuses, r.namespaceLabelsWatcher.Status())
+	}
+	r.namespacePodWatchersMu.Lock()
+	defer r.namespacePodWatchersMu.Unlock()
+	for _, pw := range r.namespacePodWatchers {
+		statuses = append(statuses, pw.Status())
+	}
+	return statuses
+}
+
+// readyHandler serves the readiness report as JSON
+func readyHandler(r *Runner, maxWatchStaleness, maxSyncStall time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		status := r.Readiness(maxWatchStaleness, maxSyncStall)
+		code := http.StatusOK
+		if !status.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, status)
+	}
+}
+
+// liveHandler reports the process as alive as long as it can serve requests
+func liveHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]bool{"alive": true})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.HTTP.Error("failed to write response", "err", err)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IPAssignment records a remote pod owning an ip, and the sets the ip was in
+type IPAssignment struct {
+	IP        string    `json:"ip"`
+	Pod       string    `json:"pod"`
+	Namespace string    `json:"namespace"`
+	Cluster   string    `json:"cluster"`
+	Sets      []string  `json:"sets"`
+	Assigned  time.Time `json:"assigned"`
+	Released  time.Time `json:"released,omitempty"`
+}
+
+// IPLookup is the current owner of an ip, if any, and its recent past owners,
+// most recent first
+type IPLookup struct {
+	IP      string         `json:"ip"`
+	Current *IPAssignment  `json:"current"`
+	History []IPAssignment `json:"history"`
+}
+
+// ipIndex maps the ips in the store back to the remote pods and sets that own
+// them, and keeps a bounded history of the released assignments, to look into
+// ips reused across pods.
+type ipIndex struct {
+	mu      sync.Mutex
+	cluster string
+	current map[string]*IPAssignment
+	// history is a ring buffer of released assignments, next is the
+	// position of the next write
+	history []IPAssignment
+	next    int
+	full    bool
+}
+
+func newIPIndex(cluster string, historySize int) *ipIndex {
+	return &ipIndex{
+		cluster: cluster,
+		current: make(map[string]*IPAssignment),
+		history: make([]IPAssignment, historySize),
+	}
+}
+
+// netIP returns the ip of a single address net, or the net itself if it is
+// not a cidr
+func netIP(n string) string {
+	ip, _, err := net.ParseCIDR(n)
+	if err != nil {
+		return n
+	}
+	return ip.String()
+}
+
+// assign records a net added to a set on behalf of a pod. An ip taken over by
+// another pod releases the previous assignment.
+func (idx *ipIndex) assign(n, pod, namespace, set string) {
+	if idx == nil {
+		return
+	}
+	ip := netIP(n)
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	a, ok := idx.current[ip]
+	if ok && (a.Pod != pod || a.Namespace != namespace) {
+		idx.release(a)
+		ok = false
+	}
+	if !ok {
+		a = &IPAssignment{
+			IP:        ip,
+			Pod:       pod,
+			Namespace: namespace,
+			Cluster:   idx.cluster,
+			Assigned:  time.Now(),
+		}
+		idx.current[ip] = a
+	}
+	if _, found := inSlice(a.Sets, set); !found {
+		a.Sets = append(a.Sets, set)
+		sort.Strings(a.Sets)
+	}
+}
+
+// unassign records a net removed from a set. The assignment is released once
+// the ip is not in any set.
+func (idx *ipIndex) unassign(n, set string) {
+	if idx == nil {
+		return
+	}
+	ip := netIP(n)
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	a, ok := idx.current[ip]
+	if !ok {
+		return
+	}
+	i, found := inSlice(a.Sets, set)
+	if !found {
+		return
+	}
+	// keep the last set in the history of the assignment
+	if len(a.Sets) == 1 {
+		idx.release(a)
+		return
+	}
+	a.Sets = removeFromSlice(a.Sets, i)
+}
+
+// release must be called with the lock held
+func (idx *ipIndex) release(a *IPAssignment) {
+	delete(idx.current, a.IP)
+	if len(idx.history) == 0 {
+		return
+	}
+	released := *a
+	released.Sets = append([]string{}, a.Sets...)
+	released.Released = time.Now()
+	idx.history[idx.next] = released
+	idx.next = (idx.next + 1) % len(idx.history)
+	if idx.next == 0 {
+		idx.full = true
+	}
+}
+
+// lookup returns the current and past owners of an ip
+func (idx *ipIndex) lookup(ip string) IPLookup {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	result := IPLookup{IP: ip, History: []IPAssignment{}}
+	if a, ok := idx.current[ip]; ok {
+		current := *a
+		current.Sets = append([]string{}, a.Sets...)
+		result.Current = &current
+	}
+	n := idx.next
+	if idx.full {
+		n = len(idx.history)
+	}
+	// walk back from the most recent release
+	for i := 1; i <= n; i++ {
+		a := idx.history[(idx.next-i+len(idx.history))%len(idx.history)]
+		if a.IP == ip {
+			result.History = append(result.History, a)
+		}
+	}
+	return result
+}
+
+// lookupHandler serves the current and past owners of an ip as JSON
+func lookupHandler(idx *ipIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(r.PathValue("ip"))
+		if ip == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid ip"})
+			return
+		}
+		result := idx.lookup(ip.String())
+		if result.Current == nil && len(result.History) == 0 {
+			writeJSON(w, http.StatusNotFound, result)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/utilitywarehouse/semaphore-policy/audit"
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+func TestIPIndex(t *testing.T) {
+	idx := newIPIndex("test", 2)
+
+	// An ip in two sets is owned by the same pod
+	idx.assign("10.0.0.1/32", "pod-1", "namespace", "set-a")
+	idx.assign("10.0.0.1/32", "pod-1", "namespace", "set-b")
+	res := idx.lookup("10.0.0.1")
+	assert.Equal(t, "pod-1", res.Current.Pod)
+	assert.Equal(t, "test", res.Current.Cluster)
+	assert.Equal(t, []string{"set-a", "set-b"}, res.Current.Sets)
+	assert.Equal(t, 0, len(res.History))
+
+	// and released once out of all the sets
+	idx.unassign("10.0.0.1/32", "set-a")
+	assert.NotNil(t, idx.lookup("10.0.0.1").Current)
+	idx.unassign("10.0.0.1/32", "set-b")
+	res = idx.lookup("10.0.0.1")
+	assert.Nil(t, res.Current)
+	assert.Equal(t, 1, len(res.History))
+	assert.Equal(t, []string{"set-b"}, res.History[0].Sets)
+	assert.False(t, res.History[0].Released.IsZero())
+
+	// An ip reused by another pod releases the previous owner
+	idx.assign("10.0.0.1/32", "pod-2", "namespace", "set-a")
+	idx.assign("10.0.0.1/32", "pod-3", "namespace", "set-a")
+	res = idx.lookup("10.0.0.1")
+	assert.Equal(t, "pod-3", res.Current.Pod)
+	assert.Equal(t, 2, len(res.History))
+	assert.Equal(t, "pod-2", res.History[0].Pod)
+	assert.Equal(t, "pod-1", res.History[1].Pod)
+
+	// The history is bounded
+	idx.assign("10.0.0.1/32", "pod-4", "namespace", "set-a")
+	res = idx.lookup("10.0.0.1")
+	assert.Equal(t, 2, len(res.History))
+	assert.Equal(t, "pod-3", res.History[0].Pod)
+	assert.Equal(t, "pod-2", res.History[1].Pod)
+}
+
+func TestIPIndexNoHistory(t *testing.T) {
+	idx := newIPIndex("test", 0)
+	idx.assign("10.0.0.1/32", "pod-1", "namespace", "set-a")
+	idx.assign("10.0.0.1/32", "pod-2", "namespace", "set-a")
+	res := idx.lookup("10.0.0.1")
+	assert.Equal(t, "pod-2", res.Current.Pod)
+	assert.Equal(t, 0, len(res.History))
+	idx.unassign("10.0.0.1/32", "set-a")
+	res = idx.lookup("10.0.0.1")
+	assert.Nil(t, res.Current)
+	assert.Equal(t, 0, len(res.History))
+}
+
+func TestLookupHandler(t *testing.T) {
+	log.InitLogger("test", "debug")
+	nss := &NetworkSetStore{
+		store:     make(map[string]*NetworkSet),
+		cluster:   "test",
+		syncQueue: make(chan SyncObject),
+		ipIndex:   newIPIndex("test", 10),
+	}
+	nss.AddNet("name", "namespace", "10.0.0.1/32", "pod-1", audit.ReasonAdd)
+	nss.AddNamespaceNet("namespace", "10.0.0.1/32", "pod-1", audit.ReasonAdd)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/lookup/10.0.0.1", nil)
+	req.SetPathValue("ip", "10.0.0.1")
+	lookupHandler(nss.ipIndex)(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res IPLookup
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, "pod-1", res.Current.Pod)
+	assert.Equal(t, "namespace", res.Current.Namespace)
+	assert.Equal(t, []string{
+		makeNetworkSetID("name", "namespace", "test"),
+		makeNamespaceNetworkSetID("namespace", "test"),
+	}, res.Current.Sets)
+
+	for ip, code := range map[string]int{
+		"10.0.0.2": http.StatusNotFound,
+		"bogus":    http.StatusBadRequest,
+	} {
+		rec = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "/lookup/"+ip, nil)
+		req.SetPathValue("ip", ip)
+		lookupHandler(nss.ipIndex)(rec, req)
+		assert.Equal(t, code, rec.Code, ip)
+	}
+}
+
+func TestLookupIPToken(t *testing.T) {
+	log.InitLogger("test", "debug")
+	idx := newIPIndex("test", 10)
+	idx.assign("10.0.0.1/32", "pod-1", "namespace", "set")
+	sm := http.NewServeMux()
+	sm.Handle("GET /lookup/{ip}", requireToken("secret", lookupHandler(idx)))
+	server := httptest.NewServer(sm)
+	defer server.Close()
+
+	_, err := lookupIP(server.URL, "", "10.0.0.1")
+	assert.ErrorContains(t, err, "401")
+	_, err = lookupIP(server.URL, "wrong", "10.0.0.1")
+	assert.ErrorContains(t, err, "401")
+	res, err := lookupIP(server.URL, "secret", "10.0.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "pod-1", res.Current.Pod)
+}
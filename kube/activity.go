@@ -0,0 +1,85 @@
+package kube
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// WatcherStatus describes the state of a watcher
+type WatcherStatus struct {
+	Name         string    `json:"name"`
+	Synced       bool      `json:"synced"`
+	ListHealthy  bool      `json:"listHealthy"`
+	WatchHealthy bool      `json:"watchHealthy"`
+	LastActivity time.Time `json:"lastActivity"`
+}
+
+// activity records the last time a watch was established or delivered an
+// event, including bookmarks which never reach the event handlers. A watch
+// that stalls silently will stop updating it.
+type activity struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (a *activity) touch() {
+	a.mu.Lock()
+	a.last = time.Now()
+	a.mu.Unlock()
+}
+
+func (a *activity) get() time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.last
+}
+
+// wrap returns a watch that records activity for every event passing through
+func (a *activity) wrap(w watch.Interface) watch.Interface {
+	a.touch()
+	rw := &recordingWatch{
+		source: w,
+		result: make(chan watch.Event),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(rw.result)
+		for {
+			select {
+			case e, ok := <-w.ResultChan():
+				if !ok {
+					return
+				}
+				a.touch()
+				select {
+				case rw.result <- e:
+				case <-rw.done:
+					return
+				}
+			case <-rw.done:
+				return
+			}
+		}
+	}()
+	return rw
+}
+
+type recordingWatch struct {
+	source   watch.Interface
+	result   chan watch.Event
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func (rw *recordingWatch) Stop() {
+	rw.stopOnce.Do(func() {
+		close(rw.done)
+		rw.source.Stop()
+	})
+}
+
+func (rw *recordingWatch) ResultChan() <-chan watch.Event {
+	return rw.result
+}
@@ -0,0 +1,31 @@
+package kube
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestActivityRecordsWatchEvents(t *testing.T) {
+	a := &activity{}
+	source := watch.NewFake()
+	w := a.wrap(source)
+	established := a.get()
+	assert.False(t, established.IsZero())
+
+	time.Sleep(time.Millisecond)
+	go source.Action(watch.Bookmark, &v1.Pod{})
+	e := <-w.ResultChan()
+	assert.Equal(t, watch.Bookmark, e.Type)
+	assert.True(t, a.get().After(established))
+
+	// Stopping the wrapper stops the source and closes the result channel
+	w.Stop()
+	w.Stop()
+	_, ok := <-w.ResultChan()
+	assert.False(t, ok)
+	assert.True(t, source.IsStopped())
+}
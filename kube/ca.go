@@ -0,0 +1,346 @@
+package kube
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/utilitywarehouse/semaphore-policy/log"
+	"github.com/utilitywarehouse/semaphore-policy/metrics"
+)
+
+const (
+	caFetchTimeout = 10 * time.Second
+	// minimum time between refreshes triggered by failed verifications
+	caMinRefreshInterval = time.Minute
+)
+
+// CASource fetches a PEM encoded CA bundle
+type CASource struct {
+	name  string
+	fetch func() ([]byte, error)
+}
+
+func (s *CASource) String() string {
+	return s.name
+}
+
+// CAConfig configures how the remote API server certificate is verified
+type CAConfig struct {
+	// Source of the CA bundle to verify the server certificate against
+	Source *CASource
+	// RefreshPeriod of the cached CA bundle, zero only refreshes on
+	// verification failures
+	RefreshPeriod time.Duration
+	// CAFingerprints are hex encoded SHA-256 fingerprints of the CA
+	// certificates to trust. If set, certificates of the fetched bundle that
+	// do not match any of them are ignored.
+	CAFingerprints []string
+	// SPKIFingerprints are hex encoded SHA-256 fingerprints of the subject
+	// public key info of the server certificate. If set, the server
+	// certificate must match one of them.
+	SPKIFingerprints []string
+}
+
+// NewURLCASource returns a source that downloads the CA bundle from a URL,
+// through the proxy returned by the proxy func. If roots is not nil, it will be
+// used instead of the system roots to verify https URLs.
+func NewURLCASource(url string, roots *x509.CertPool, proxy ProxyFunc) *CASource {
+	if strings.HasPrefix(url, "http://") {
+		log.Logger.Warn("remote CA is fetched over plain http, consider using https or pinning its fingerprint", "url", url)
+	}
+	client := &http.Client{
+		Timeout: caFetchTimeout,
+		Transport: &http.Transport{
+			Proxy:           proxy,
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		},
+	}
+	return &CASource{
+		name: url,
+		fetch: func() ([]byte, error) {
+			resp, err := client.Get(url)
+			if err != nil {
+				return nil, fmt.Errorf("error getting remote CA from %s: %v", url, err)
+			}
+			defer func() {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}()
+			if resp.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("expected %d response from %s, got %d", http.StatusOK, url, resp.StatusCode)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return nil, fmt.Errorf("error reading response body from %s: %v", url, err)
+			}
+			return body, nil
+		},
+	}
+}
+
+// NewFileCASource returns a source that reads the CA bundle from a file
+func NewFileCASource(path string) *CASource {
+	return &CASource{
+		name: path,
+		fetch: func() ([]byte, error) {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("error reading remote CA from %s: %v", path, err)
+			}
+			return data, nil
+		},
+	}
+}
+
+// NewInlineCASource returns a source for a base64 encoded CA bundle
+func NewInlineCASource(data string) (*CASource, error) {
+	pemData, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding inline remote CA: %v", err)
+	}
+	return &CASource{
+		name: "inline",
+		fetch: func() ([]byte, error) {
+			return pemData, nil
+		},
+	}, nil
+}
+
+// LoadCertPool reads a PEM bundle file into a certificate pool
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// certMan verifies remote server certificates against a CA bundle that is
+// fetched from its source periodically. The last successfully fetched bundle
+// is kept, so that failures of the source do not break connections.
+type certMan struct {
+	source        *CASource
+	refreshPeriod time.Duration
+	caPins        [][]byte
+	spkiPins      [][]byte
+	mu            sync.Mutex
+	roots         *x509.CertPool
+	lastRefresh   time.Time
+}
+
+func newCertMan(conf CAConfig) (*certMan, error) {
+	caPins, err := parseFingerprints(conf.CAFingerprints)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA fingerprint: %v", err)
+	}
+	spkiPins, err := parseFingerprints(conf.SPKIFingerprints)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SPKI fingerprint: %v", err)
+	}
+	return &certMan{
+		source:        conf.Source,
+		refreshPeriod: conf.RefreshPeriod,
+		caPins:        caPins,
+		spkiPins:      spkiPins,
+	}, nil
+}
+
+// run refreshes the CA bundle periodically and never returns, unless refreshing
+// is disabled.
+func (cm *certMan) run() {
+	if cm.refreshPeriod <= 0 {
+		return
+	}
+	for range time.Tick(cm.refreshPeriod) {
+		if _, err := cm.refresh(); err != nil {
+			log.Logger.Error("failed to refresh remote CA, keeping the last known one", "source", cm.source, "err", err)
+		}
+	}
+}
+
+// refresh fetches and parses the CA bundle and replaces the cached one on
+// success
+func (cm *certMan) refresh() (*x509.CertPool, error) {
+	cm.mu.Lock()
+	cm.lastRefresh = time.Now()
+	cm.mu.Unlock()
+	body, err := cm.source.fetch()
+	if err != nil {
+		metrics.IncRemoteCAFetchFailures()
+		return nil, err
+	}
+	certs, err := parseCABundle(body)
+	if err != nil {
+		metrics.IncRemoteCAFetchFailures()
+		return nil, fmt.Errorf("failed to parse root certificate from %s: %v", cm.source, err)
+	}
+	if len(cm.caPins) > 0 {
+		certs, err = pinnedCerts(certs, cm.caPins)
+		if err != nil {
+			metrics.IncRemoteCAFetchFailures()
+			return nil, fmt.Errorf("refusing remote CA from %s: %v", cm.source, err)
+		}
+	}
+	roots := x509.NewCertPool()
+	var expiry time.Time
+	for _, cert := range certs {
+		roots.AddCert(cert)
+		if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter
+		}
+	}
+	metrics.SetRemoteCAExpiry(expiry)
+	cm.mu.Lock()
+	cm.roots = roots
+	cm.mu.Unlock()
+	return roots, nil
+}
+
+// cachedRoots returns the cached CA bundle, fetching it if missing
+func (cm *certMan) cachedRoots() (*x509.CertPool, error) {
+	cm.mu.Lock()
+	roots := cm.roots
+	cm.mu.Unlock()
+	if roots != nil {
+		return roots, nil
+	}
+	return cm.refresh()
+}
+
+func (cm *certMan) verifyConn(cs tls.ConnectionState) error {
+	if err := cm.verifyChain(cs); err != nil {
+		return err
+	}
+	if len(cm.spkiPins) > 0 {
+		fingerprint := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		if !matchesFingerprint(fingerprint[:], cm.spkiPins) {
+			return fmt.Errorf("refusing remote server %s: public key fingerprint %x does not match any pinned fingerprint", cs.ServerName, fingerprint)
+		}
+	}
+	return nil
+}
+
+func (cm *certMan) verifyChain(cs tls.ConnectionState) error {
+	roots, err := cm.cachedRoots()
+	if err != nil {
+		return err
+	}
+	err = verifyPeer(cs, roots)
+	if err == nil {
+		return nil
+	}
+	// The CA might have been rotated since the last refresh
+	cm.mu.Lock()
+	stale := time.Since(cm.lastRefresh) > caMinRefreshInterval
+	cm.mu.Unlock()
+	if !stale {
+		return err
+	}
+	log.Logger.Info("remote certificate verification failed, refreshing CA", "source", cm.source, "err", err)
+	roots, rerr := cm.refresh()
+	if rerr != nil {
+		log.Logger.Error("failed to refresh remote CA", "source", cm.source, "err", rerr)
+		return err
+	}
+	return verifyPeer(cs, roots)
+}
+
+func verifyPeer(cs tls.ConnectionState, roots *x509.CertPool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no peer certificates presented")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// parseCABundle returns the certificates in a PEM bundle
+func parseCABundle(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+	return certs, nil
+}
+
+// pinnedCerts returns the certificates that match one of the fingerprints
+func pinnedCerts(certs []*x509.Certificate, pins [][]byte) ([]*x509.Certificate, error) {
+	var pinned []*x509.Certificate
+	var fingerprints []string
+	for _, cert := range certs {
+		fingerprint := sha256.Sum256(cert.Raw)
+		if matchesFingerprint(fingerprint[:], pins) {
+			pinned = append(pinned, cert)
+		}
+		fingerprints = append(fingerprints, hex.EncodeToString(fingerprint[:]))
+	}
+	if len(pinned) == 0 {
+		return nil, fmt.Errorf("no certificate matches the pinned fingerprints, got %s", strings.Join(fingerprints, ","))
+	}
+	return pinned, nil
+}
+
+func matchesFingerprint(fingerprint []byte, pins [][]byte) bool {
+	for _, pin := range pins {
+		if bytes.Equal(fingerprint, pin) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFingerprints decodes hex encoded SHA-256 fingerprints, optionally
+// separated by colons as printed by `openssl x509 -fingerprint -sha256`
+func parseFingerprints(fingerprints []string) ([][]byte, error) {
+	var pins [][]byte
+	for _, f := range fingerprints {
+		pin, err := hex.DecodeString(strings.ReplaceAll(f, ":", ""))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		if len(pin) != sha256.Size {
+			return nil, fmt.Errorf("%s: expected %d bytes, got %d", f, sha256.Size, len(pin))
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
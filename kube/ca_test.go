@@ -0,0 +1,180 @@
+package kube
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+func testCAPEM(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func testClient(cm *certMan) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				VerifyConnection:   cm.verifyConn,
+			},
+		},
+	}
+}
+
+func TestCertManCachesLastKnownCA(t *testing.T) {
+	log.InitLogger("test", "debug")
+	apiServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer apiServer.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: apiServer.Certificate().Raw})
+
+	var caRequests int32
+	var caDown atomic.Bool
+	caServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&caRequests, 1)
+		if caDown.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(caPEM)
+	}))
+	defer caServer.Close()
+
+	cm, err := newCertMan(CAConfig{Source: NewURLCASource(caServer.URL, nil, nil)})
+	assert.NoError(t, err)
+	client := testClient(cm)
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(apiServer.URL)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+	// The CA is fetched once and reused for every handshake
+	assert.Equal(t, int32(1), atomic.LoadInt32(&caRequests))
+
+	// Failed refreshes keep the last known CA
+	caDown.Store(true)
+	_, err = cm.refresh()
+	assert.Error(t, err)
+	resp, err := client.Get(apiServer.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestCertManRejectsUnknownCA(t *testing.T) {
+	log.InitLogger("test", "debug")
+	apiServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer apiServer.Close()
+	// httptest servers share the same certificate, so generate another CA
+	otherPEM := testCAPEM(t)
+
+	source, err := NewInlineCASource(base64.StdEncoding.EncodeToString(otherPEM))
+	assert.NoError(t, err)
+	cm, err := newCertMan(CAConfig{Source: source})
+	assert.NoError(t, err)
+	_, err = testClient(cm).Get(apiServer.URL)
+	assert.Error(t, err)
+}
+
+func TestCertManPinnedFingerprints(t *testing.T) {
+	log.InitLogger("test", "debug")
+	apiServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer apiServer.Close()
+	cert := apiServer.Certificate()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	source, err := NewInlineCASource(base64.StdEncoding.EncodeToString(caPEM))
+	assert.NoError(t, err)
+	caFingerprint := sha256.Sum256(cert.Raw)
+	spkiFingerprint := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	wrong := strings.Repeat("00", sha256.Size)
+
+	// Matching pins, colon separated as printed by openssl
+	var colonSeparated []string
+	for _, b := range caFingerprint {
+		colonSeparated = append(colonSeparated, fmt.Sprintf("%02X", b))
+	}
+	cm, err := newCertMan(CAConfig{
+		Source:           source,
+		CAFingerprints:   []string{wrong, strings.Join(colonSeparated, ":")},
+		SPKIFingerprints: []string{hex.EncodeToString(spkiFingerprint[:])},
+	})
+	assert.NoError(t, err)
+	resp, err := testClient(cm).Get(apiServer.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	// CA fingerprint mismatch
+	cm, err = newCertMan(CAConfig{Source: source, CAFingerprints: []string{wrong}})
+	assert.NoError(t, err)
+	_, err = cm.refresh()
+	assert.ErrorContains(t, err, "no certificate matches the pinned fingerprints")
+
+	// SPKI fingerprint mismatch
+	cm, err = newCertMan(CAConfig{Source: source, SPKIFingerprints: []string{wrong}})
+	assert.NoError(t, err)
+	_, err = testClient(cm).Get(apiServer.URL)
+	assert.ErrorContains(t, err, "does not match any pinned fingerprint")
+
+	// Invalid pins
+	_, err = newCertMan(CAConfig{Source: source, CAFingerprints: []string{"abc"}})
+	assert.Error(t, err)
+}
+
+func TestURLCASourceCustomRoots(t *testing.T) {
+	log.InitLogger("test", "debug")
+	caPEM := testCAPEM(t)
+	caServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(caPEM)
+	}))
+	defer caServer.Close()
+
+	// The test server is not trusted by the system roots
+	_, err := NewURLCASource(caServer.URL, nil, nil).fetch()
+	assert.Error(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caServer.Certificate())
+	body, err := NewURLCASource(caServer.URL, roots, nil).fetch()
+	assert.NoError(t, err)
+	assert.Equal(t, caPEM, body)
+}
+
+func TestParseCABundle(t *testing.T) {
+	_, err := parseCABundle([]byte("not a certificate"))
+	assert.Error(t, err)
+
+	certs, err := parseCABundle(testCAPEM(t))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(certs))
+}
@@ -1,85 +1,109 @@
 package kube
 
 import (
-	"fmt"
-	"io"
-
 	"crypto/tls"
-	"crypto/x509"
-	"io/ioutil"
+	"fmt"
 	"net/http"
+	"time"
 
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
+	"github.com/utilitywarehouse/semaphore-policy/log"
+
 	// in case of local kube config
 	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
 )
 
-type certMan struct {
-	caURL string
+// ClientOptions tune the rate limiting and timeouts of a client. Zero values
+// keep the client-go defaults.
+type ClientOptions struct {
+	// QPS is the maximum sustained queries per second to the API server
+	QPS float32
+	// Burst is the maximum burst of queries above QPS
+	Burst int
+	// Timeout of each request. It also applies to watches, so it should
+	// only be set for clients that do not watch resources.
+	Timeout time.Duration
 }
 
-func (cm *certMan) verifyConn(cs tls.ConnectionState) error {
-	resp, err := http.Get(cm.caURL)
-	if err != nil {
-		return fmt.Errorf("error getting remote CA from %s: %v", cm.caURL, err)
-	}
-	defer func() {
-		io.Copy(ioutil.Discard, resp.Body)
-		resp.Body.Close()
-	}()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("expected %d response from %s, got %d", http.StatusOK, cm.caURL, resp.StatusCode)
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("error reading response body from %s: %v", cm.caURL, err)
+func (o ClientOptions) apply(conf *rest.Config) {
+	if o.QPS > 0 {
+		conf.QPS = o.QPS
 	}
-	roots := x509.NewCertPool()
-	ok := roots.AppendCertsFromPEM(body)
-	if !ok {
-		return fmt.Errorf("failed to parse root certificate from %s", cm.caURL)
+	if o.Burst > 0 {
+		conf.Burst = o.Burst
 	}
-	opts := x509.VerifyOptions{
-		DNSName: cs.ServerName,
-		Roots:   roots,
+	if o.Timeout > 0 {
+		conf.Timeout = o.Timeout
 	}
-	_, err = cs.PeerCertificates[0].Verify(opts)
-	return err
 }
 
-// Client returns a Kubernetes client (clientset) from token, apiURL and caURL
-func Client(token, apiURL, caURL string) (*kubernetes.Clientset, error) {
-	cm := &certMan{caURL}
+// Client returns a Kubernetes client (clientset) from token, apiURL and the
+// configuration to verify the server certificate. The CA bundle is cached and
+// refreshed periodically, see CAConfig. Connections to the API server go
+// through the proxy returned by the proxy func.
+func Client(token, apiURL string, ca CAConfig, proxy ProxyFunc, opts ClientOptions) (*kubernetes.Clientset, error) {
+	cm, err := newCertMan(ca)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cm.refresh(); err != nil {
+		// Do not fail here, the CA will be fetched again on the first
+		// connection
+		log.Logger.Error("failed to fetch remote CA", "source", ca.Source, "err", err)
+	}
+	go cm.run()
 	conf := &rest.Config{
 		Host: apiURL,
 		Transport: &http.Transport{
+			Proxy: proxy,
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: true,
 				VerifyConnection:   cm.verifyConn}},
 		BearerToken: token,
 	}
+	opts.apply(conf)
 	return kubernetes.NewForConfig(conf)
 }
 
 // ClientFromConfig returns a Kubernetes client (clientset) from the kubeconfig
-// path or from the in-cluster service account environment.
-func ClientFromConfig(path string) (*kubernetes.Clientset, error) {
-	conf, err := GetClientConfig(path)
+// path or from the in-cluster service account environment. An empty context
+// will use the current context of the kubeconfig. A non nil proxy func
+// overrides the proxy of the kubeconfig cluster.
+func ClientFromConfig(path, context string, proxy ProxyFunc, opts ClientOptions) (*kubernetes.Clientset, error) {
+	conf, err := GetClientConfig(path, context, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get Kubernetes client config: %v", err)
 	}
+	if proxy != nil {
+		conf.Proxy = proxy
+	}
 	return kubernetes.NewForConfig(conf)
 }
 
-// GetClientConfig returns a Kubernetes client Config.
-func GetClientConfig(path string) (*rest.Config, error) {
+// GetClientConfig returns a Kubernetes client Config. Users of the kubeconfig
+// can authenticate via exec credential plugins, in which case the plugin
+// command needs to be available to the operator.
+func GetClientConfig(path, context string, opts ClientOptions) (*rest.Config, error) {
+	var conf *rest.Config
+	var err error
 	if path != "" {
-		// build Config from a kubeconfig filepath
-		return clientcmd.BuildConfigFromFlags("", path)
+		// build Config from a kubeconfig filepath and context
+		conf, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: path},
+			&clientcmd.ConfigOverrides{CurrentContext: context},
+		).ClientConfig()
+	} else if context != "" {
+		return nil, fmt.Errorf("kube context %s requires a kubeconfig path", context)
+	} else {
+		// uses pod's service account to get a Config
+		conf, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
 	}
-	// uses pod's service account to get a Config
-	return rest.InClusterConfig()
+	opts.apply(conf)
+	return conf, nil
 }
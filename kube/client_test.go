@@ -0,0 +1,67 @@
+package kube
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testKubeConfig = `apiVersion: v1
+kind: Config
+current-context: one
+clusters:
+- name: one
+  cluster:
+    server: https://one.example.com
+- name: two
+  cluster:
+    server: https://two.example.com
+contexts:
+- name: one
+  context:
+    cluster: one
+    user: token
+- name: two
+  context:
+    cluster: two
+    user: exec
+users:
+- name: token
+  user:
+    token: secret
+- name: exec
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1
+      command: get-token
+      args: ["--cluster", "two"]
+      interactiveMode: Never
+`
+
+func TestGetClientConfigContexts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	assert.NoError(t, os.WriteFile(path, []byte(testKubeConfig), 0600))
+
+	conf, err := GetClientConfig(path, "", ClientOptions{QPS: 20, Burst: 40})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://one.example.com", conf.Host)
+	assert.Equal(t, "secret", conf.BearerToken)
+	assert.Equal(t, float32(20), conf.QPS)
+	assert.Equal(t, 40, conf.Burst)
+	assert.Equal(t, time.Duration(0), conf.Timeout)
+
+	conf, err = GetClientConfig(path, "two", ClientOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://two.example.com", conf.Host)
+	assert.NotNil(t, conf.ExecProvider)
+	assert.Equal(t, "get-token", conf.ExecProvider.Command)
+
+	_, err = GetClientConfig(path, "missing", ClientOptions{})
+	assert.Error(t, err)
+
+	_, err = GetClientConfig("", "two", ClientOptions{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,159 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/utilitywarehouse/semaphore-policy/log"
+	"github.com/utilitywarehouse/semaphore-policy/metrics"
+)
+
+// NamespaceEventHandler is the function to handle new events
+type NamespaceEventHandler = func(eventType watch.EventType, old *v1.Namespace, new *v1.Namespace)
+
+// NamespaceWatcher has a watch on the clients namespaces
+type NamespaceWatcher struct {
+	ctx           context.Context
+	client        kubernetes.Interface
+	resyncPeriod  time.Duration
+	stopChannel   chan struct{}
+	store         cache.Store
+	controller    cache.Controller
+	eventHandler  NamespaceEventHandler
+	labelSelector string
+	// ListHealthy and WatchHealthy are set by the reflector goroutines
+	ListHealthy  atomic.Bool
+	WatchHealthy atomic.Bool
+	activity     activity
+}
+
+// NewNamespaceWatcher returns a new namespace watcher.
+func NewNamespaceWatcher(client kubernetes.Interface, resyncPeriod time.Duration, handler NamespaceEventHandler, labelSelector string) *NamespaceWatcher {
+	return &NamespaceWatcher{
+		ctx:           context.Background(),
+		client:        client,
+		resyncPeriod:  resyncPeriod,
+		stopChannel:   make(chan struct{}),
+		eventHandler:  handler,
+		labelSelector: labelSelector,
+	}
+}
+
+// Init sets up the list, watch functions and the cache.
+func (nw *NamespaceWatcher) Init() {
+	listWatch := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = nw.labelSelector
+			l, err := nw.client.CoreV1().Namespaces().List(nw.ctx, options)
+			if err != nil {
+				log.PodWatcher.Error("nw: list error", "err", err)
+				nw.ListHealthy.Store(false)
+				metrics.IncNamespaceWatcherFailures("list")
+			} else {
+				nw.ListHealthy.Store(true)
+				nw.activity.touch()
+			}
+			return l, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = nw.labelSelector
+			w, err := nw.client.CoreV1().Namespaces().Watch(nw.ctx, options)
+			if err != nil {
+				log.PodWatcher.Error("nw: watch error", "err", err)
+				nw.WatchHealthy.Store(false)
+				metrics.IncNamespaceWatcherFailures("watch")
+			} else {
+				nw.WatchHealthy.Store(true)
+				w = nw.activity.wrap(w)
+			}
+			return w, err
+		},
+	}
+	eventHandler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			nw.eventHandler(watch.Added, nil, obj.(*v1.Namespace))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			nw.eventHandler(watch.Modified, oldObj.(*v1.Namespace), newObj.(*v1.Namespace))
+		},
+		DeleteFunc: func(obj interface{}) {
+			// A namespace that was unlabelled while the watch was down
+			// will arrive wrapped in a tombstone.
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			ns, ok := obj.(*v1.Namespace)
+			if !ok {
+				log.PodWatcher.Error("nw: unexpected object on delete", "obj", obj)
+				return
+			}
+			nw.eventHandler(watch.Deleted, ns, nil)
+		},
+	}
+	nw.store, nw.controller = cache.NewInformer(listWatch, &v1.Namespace{}, nw.resyncPeriod, eventHandler)
+}
+
+// Run will not return unless writting in the stop channel
+func (nw *NamespaceWatcher) Run() {
+	log.PodWatcher.Info("starting namespace watcher")
+	// Running controller will block until writing on the stop channel.
+	nw.controller.Run(nw.stopChannel)
+	log.PodWatcher.Info("stopped namespace watcher")
+}
+
+// Stop stop the watcher via the respective channel
+func (nw *NamespaceWatcher) Stop() {
+	log.PodWatcher.Info("stopping namespace watcher")
+	close(nw.stopChannel)
+}
+
+// HasSynced calls controllers HasSync method to determine whether the watcher
+// cache is synced.
+func (nw *NamespaceWatcher) HasSynced() bool {
+	return nw.controller.HasSynced()
+}
+
+// List lists all namespaces from the store
+func (nw *NamespaceWatcher) List() ([]*v1.Namespace, error) {
+	var namespaces []*v1.Namespace
+	for _, obj := range nw.store.List() {
+		ns, ok := obj.(*v1.Namespace)
+		if !ok {
+			return nil, fmt.Errorf("unexpected object in store: %+v", obj)
+		}
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces, nil
+}
+
+// Status returns the current state of the watcher
+func (nw *NamespaceWatcher) Status() WatcherStatus {
+	name := "namespaces"
+	if nw.labelSelector != "" {
+		name = fmt.Sprintf("namespaces/%s", nw.labelSelector)
+	}
+	return WatcherStatus{
+		Name:         name,
+		Synced:       nw.controller != nil && nw.controller.HasSynced(),
+		ListHealthy:  nw.ListHealthy.Load(),
+		WatchHealthy: nw.WatchHealthy.Load(),
+		LastActivity: nw.activity.get(),
+	}
+}
+
+// Healthy is true when both list and watch handlers are running without errors.
+func (nw *NamespaceWatcher) Healthy() bool {
+	if nw.ListHealthy.Load() && nw.WatchHealthy.Load() {
+		return true
+	}
+	return false
+}
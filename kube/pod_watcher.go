@@ -3,6 +3,8 @@ package kube
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
@@ -19,6 +21,9 @@ import (
 // PodEventHandler is the function to handle new events
 type PodEventHandler = func(eventType watch.EventType, old *v1.Pod, new *v1.Pod)
 
+// PodFilter decides whether a pod should be passed to the event handler
+type PodFilter = func(pod *v1.Pod) bool
+
 // PodWatcher has a watch on the clients pods
 type PodWatcher struct {
 	ctx           context.Context
@@ -28,20 +33,30 @@ type PodWatcher struct {
 	store         cache.Store
 	controller    cache.Controller
 	eventHandler  PodEventHandler
+	filter        PodFilter
+	transform     cache.TransformFunc
 	labelSelector string
-	ListHealthy   bool
-	WatchHealthy  bool
+	namespace     string
+	// ListHealthy and WatchHealthy are set by the reflector goroutines
+	ListHealthy  atomic.Bool
+	WatchHealthy atomic.Bool
+	activity     activity
 }
 
-// NewPodWatcher returns a new pod wathcer.
-func NewPodWatcher(client kubernetes.Interface, resyncPeriod time.Duration, handler PodEventHandler, labelSelector string) *PodWatcher {
+// NewPodWatcher returns a new pod wathcer. An empty namespace will watch pods
+// in all namespaces. A nil filter will pass all pods to the handler. The
+// transform is applied to pods before they are cached, see PodProjection.
+func NewPodWatcher(client kubernetes.Interface, resyncPeriod time.Duration, handler PodEventHandler, filter PodFilter, transform cache.TransformFunc, labelSelector, namespace string) *PodWatcher {
 	return &PodWatcher{
 		ctx:           context.Background(),
 		client:        client,
 		resyncPeriod:  resyncPeriod,
 		stopChannel:   make(chan struct{}),
 		eventHandler:  handler,
+		filter:        filter,
+		transform:     transform,
 		labelSelector: labelSelector,
+		namespace:     namespace,
 	}
 }
 
@@ -50,55 +65,142 @@ func (pw *PodWatcher) Init() {
 	listWatch := &cache.ListWatch{
 		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
 			options.LabelSelector = pw.labelSelector
-			l, err := pw.client.CoreV1().Pods(metav1.NamespaceAll).List(pw.ctx, options)
+			l, err := pw.client.CoreV1().Pods(pw.namespace).List(pw.ctx, options)
 			if err != nil {
-				log.Logger.Error("pw: list error", "err", err)
-				pw.ListHealthy = false
+				log.PodWatcher.Error("pw: list error", "namespace", pw.namespace, "err", err)
+				pw.ListHealthy.Store(false)
 				metrics.IncPodWatcherFailures("list")
 			} else {
-				pw.ListHealthy = true
+				pw.ListHealthy.Store(true)
+				pw.activity.touch()
 			}
 			return l, err
 		},
 		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
 			options.LabelSelector = pw.labelSelector
-			w, err := pw.client.CoreV1().Pods(metav1.NamespaceAll).Watch(pw.ctx, options)
+			w, err := pw.client.CoreV1().Pods(pw.namespace).Watch(pw.ctx, options)
 			if err != nil {
-				log.Logger.Error("pw: watch error", "err", err)
-				pw.WatchHealthy = false
+				log.PodWatcher.Error("pw: watch error", "namespace", pw.namespace, "err", err)
+				pw.WatchHealthy.Store(false)
 				metrics.IncPodWatcherFailures("watch")
 			} else {
-				pw.WatchHealthy = true
+				pw.WatchHealthy.Store(true)
+				w = pw.activity.wrap(w)
 			}
 			return w, err
 		},
 	}
 	eventHandler := cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			pw.eventHandler(watch.Added, nil, obj.(*v1.Pod))
-		},
-		UpdateFunc: func(oldObj, newObj interface{}) {
-			pw.eventHandler(watch.Modified, oldObj.(*v1.Pod), newObj.(*v1.Pod))
+			metrics.IncPodWatcherCachedPods(pw.name(), pw.namespace)
+			pod := obj.(*v1.Pod)
+			if pw.accepts(pod) {
+				pw.eventHandler(watch.Added, nil, pod)
+			}
 		},
+		UpdateFunc: pw.update,
 		DeleteFunc: func(obj interface{}) {
-			pw.eventHandler(watch.Deleted, obj.(*v1.Pod), nil)
+			metrics.DecPodWatcherCachedPods(pw.name(), pw.namespace)
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			pod, ok := obj.(*v1.Pod)
+			if !ok {
+				log.PodWatcher.Error("pw: unexpected object on delete", "obj", obj)
+				return
+			}
+			if pw.accepts(pod) {
+				pw.eventHandler(watch.Deleted, pod, nil)
+			}
 		},
 	}
-	pw.store, pw.controller = cache.NewInformer(listWatch, &v1.Pod{}, pw.resyncPeriod, eventHandler)
+	pw.store, pw.controller = cache.NewInformerWithOptions(cache.InformerOptions{
+		ListerWatcher: listWatch,
+		ObjectType:    &v1.Pod{},
+		Handler:       eventHandler,
+		ResyncPeriod:  pw.resyncPeriod,
+		Transform:     pw.transform,
+	})
+}
+
+// PodProjection returns a cache transform that strips pods down to the fields
+// needed to track their addresses: name, namespace, labels, annotations with
+// one of the given prefixes, deletion timestamp, host network, phase,
+// conditions and pod IPs. This keeps the memory used by the cache of large
+// clusters low.
+func PodProjection(annotationPrefixes ...string) cache.TransformFunc {
+	return func(obj interface{}) (interface{}, error) {
+		pod, ok := obj.(*v1.Pod)
+		if !ok {
+			return obj, nil
+		}
+		var annotations map[string]string
+		for k, v := range pod.Annotations {
+			for _, prefix := range annotationPrefixes {
+				if strings.HasPrefix(k, prefix) {
+					if annotations == nil {
+						annotations = make(map[string]string)
+					}
+					annotations[k] = v
+					break
+				}
+			}
+		}
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              pod.Name,
+				Namespace:         pod.Namespace,
+				UID:               pod.UID,
+				ResourceVersion:   pod.ResourceVersion,
+				Labels:            pod.Labels,
+				Annotations:       annotations,
+				DeletionTimestamp: pod.DeletionTimestamp,
+			},
+			Spec: v1.PodSpec{
+				HostNetwork: pod.Spec.HostNetwork,
+			},
+			Status: v1.PodStatus{
+				Phase:      pod.Status.Phase,
+				Conditions: pod.Status.Conditions,
+				PodIP:      pod.Status.PodIP,
+				PodIPs:     pod.Status.PodIPs,
+			},
+		}, nil
+	}
+}
+
+func (pw *PodWatcher) accepts(pod *v1.Pod) bool {
+	return pw.filter == nil || pw.filter(pod)
+}
+
+// update passes a pod update to the handler. Pods passing or failing the
+// filter after an update are seen as added or deleted respectively.
+func (pw *PodWatcher) update(oldObj, newObj interface{}) {
+	oldPod, newPod := oldObj.(*v1.Pod), newObj.(*v1.Pod)
+	oldOK, newOK := pw.accepts(oldPod), pw.accepts(newPod)
+	switch {
+	case oldOK && newOK:
+		pw.eventHandler(watch.Modified, oldPod, newPod)
+	case oldOK:
+		pw.eventHandler(watch.Deleted, oldPod, nil)
+	case newOK:
+		pw.eventHandler(watch.Added, nil, newPod)
+	}
 }
 
 // Run will not return unless writting in the stop channel
 func (pw *PodWatcher) Run() {
-	log.Logger.Info("starting pod watcher")
+	log.PodWatcher.Info("starting pod watcher", "namespace", pw.namespace)
 	// Running controller will block until writing on the stop channel.
 	pw.controller.Run(pw.stopChannel)
-	log.Logger.Info("stopped pod watcher")
+	log.PodWatcher.Info("stopped pod watcher", "namespace", pw.namespace)
 }
 
 // Stop stop the watcher via the respective channel
 func (pw *PodWatcher) Stop() {
-	log.Logger.Info("stopping pod watcher")
+	log.PodWatcher.Info("stopping pod watcher", "namespace", pw.namespace)
 	close(pw.stopChannel)
+	metrics.DeletePodWatcherCachedPods(pw.name(), pw.namespace)
 }
 
 // HasSynced calls controllers HasSync method to determine whether the watcher
@@ -120,9 +222,33 @@ func (pw *PodWatcher) List() ([]*v1.Pod, error) {
 	return svcs, nil
 }
 
+// name identifies the watcher in its status and metrics. Watchers of the
+// same namespace are told apart by their label selector.
+func (pw *PodWatcher) name() string {
+	name := "pods"
+	if pw.namespace != "" {
+		name = fmt.Sprintf("%s/%s", name, pw.namespace)
+	}
+	if pw.labelSelector != "" {
+		name = fmt.Sprintf("%s/%s", name, pw.labelSelector)
+	}
+	return name
+}
+
+// Status returns the current state of the watcher
+func (pw *PodWatcher) Status() WatcherStatus {
+	return WatcherStatus{
+		Name:         pw.name(),
+		Synced:       pw.controller != nil && pw.controller.HasSynced(),
+		ListHealthy:  pw.ListHealthy.Load(),
+		WatchHealthy: pw.WatchHealthy.Load(),
+		LastActivity: pw.activity.get(),
+	}
+}
+
 // Healthy is true when both list and watch handlers are running without errors.
 func (pw *PodWatcher) Healthy() bool {
-	if pw.ListHealthy && pw.WatchHealthy {
+	if pw.ListHealthy.Load() && pw.WatchHealthy.Load() {
 		return true
 	}
 	return false
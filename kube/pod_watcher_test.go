@@ -0,0 +1,118 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestPodProjection(t *testing.T) {
+	now := metav1.Now()
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "pod",
+			Namespace:       "namespace",
+			ResourceVersion: "10",
+			Labels:          map[string]string{"app": "app"},
+			Annotations: map[string]string{
+				"policy.semaphore.uw.io/exclude":                   "true",
+				"kubectl.kubernetes.io/last-applied-configuration": "{}",
+			},
+			DeletionTimestamp: &now,
+			ManagedFields:     []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+		},
+		Spec: v1.PodSpec{
+			HostNetwork: true,
+			Containers:  []v1.Container{{Name: "app", Env: []v1.EnvVar{{Name: "A", Value: "B"}}}},
+		},
+		Status: v1.PodStatus{
+			Phase:      v1.PodRunning,
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+			PodIP:      "10.0.0.1",
+			PodIPs:     []v1.PodIP{{IP: "10.0.0.1"}},
+			HostIP:     "192.168.0.1",
+		},
+	}
+	obj, err := PodProjection("policy.semaphore.uw.io/")(pod)
+	assert.NoError(t, err)
+	projected := obj.(*v1.Pod)
+	assert.Equal(t, "pod", projected.Name)
+	assert.Equal(t, "namespace", projected.Namespace)
+	assert.Equal(t, "10", projected.ResourceVersion)
+	assert.Equal(t, pod.Labels, projected.Labels)
+	assert.Equal(t, map[string]string{"policy.semaphore.uw.io/exclude": "true"}, projected.Annotations)
+	assert.Equal(t, &now, projected.DeletionTimestamp)
+	assert.Nil(t, projected.ManagedFields)
+	assert.True(t, projected.Spec.HostNetwork)
+	assert.Nil(t, projected.Spec.Containers)
+	assert.Equal(t, v1.PodRunning, projected.Status.Phase)
+	assert.Equal(t, pod.Status.Conditions, projected.Status.Conditions)
+	assert.Equal(t, "10.0.0.1", projected.Status.PodIP)
+	assert.Equal(t, pod.Status.PodIPs, projected.Status.PodIPs)
+	assert.Equal(t, "", projected.Status.HostIP)
+
+	// Projecting twice is a no-op
+	again, err := PodProjection("policy.semaphore.uw.io/")(projected)
+	assert.NoError(t, err)
+	assert.Equal(t, projected, again)
+
+	// Other objects are left untouched
+	ns := &v1.Namespace{}
+	obj, err = PodProjection()(ns)
+	assert.NoError(t, err)
+	assert.Equal(t, ns, obj)
+}
+
+func TestPodWatcherUpdate(t *testing.T) {
+	const exclude = "policy.semaphore.uw.io/exclude"
+	pod := func(annotations map[string]string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Annotations: annotations}}
+	}
+	excluded := map[string]string{exclude: "true"}
+	filter := func(pod *v1.Pod) bool { return pod.Annotations[exclude] != "true" }
+	tests := []struct {
+		name     string
+		old, new *v1.Pod
+		event    watch.EventType
+	}{
+		{"both pass the filter", pod(nil), pod(map[string]string{"a": "b"}), watch.Modified},
+		{"opt-out annotation added", pod(nil), pod(excluded), watch.Deleted},
+		{"opt-out annotation removed", pod(excluded), pod(nil), watch.Added},
+		{"neither passes the filter", pod(excluded), pod(excluded), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var event watch.EventType
+			var old, new *v1.Pod
+			pw := NewPodWatcher(nil, 0, func(e watch.EventType, o, n *v1.Pod) {
+				event, old, new = e, o, n
+			}, filter, nil, "", "")
+			pw.update(test.old, test.new)
+			assert.Equal(t, test.event, event)
+			switch test.event {
+			case watch.Modified:
+				assert.Equal(t, test.old, old)
+				assert.Equal(t, test.new, new)
+			case watch.Deleted:
+				assert.Equal(t, test.old, old)
+				assert.Nil(t, new)
+			case watch.Added:
+				assert.Nil(t, old)
+				assert.Equal(t, test.new, new)
+			}
+		})
+	}
+}
+
+func TestPodWatcherName(t *testing.T) {
+	// The watcher of the set labels and the watcher of an exported namespace
+	// are told apart in their status and metrics
+	sets := NewPodWatcher(nil, 0, nil, nil, nil, "policy.semaphore.uw.io/name", "namespace")
+	namespace := NewPodWatcher(nil, 0, nil, nil, nil, "", "namespace")
+	assert.Equal(t, "pods/namespace/policy.semaphore.uw.io/name", sets.Status().Name)
+	assert.Equal(t, "pods/namespace", namespace.Status().Name)
+	assert.Equal(t, "pods", NewPodWatcher(nil, 0, nil, nil, nil, "", "").Status().Name)
+}
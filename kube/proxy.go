@@ -0,0 +1,29 @@
+package kube
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ProxyFunc returns the proxy to use for a request, see http.Transport
+type ProxyFunc = func(*http.Request) (*url.URL, error)
+
+// Proxy returns a ProxyFunc for a http, https or socks5 proxy URL. An empty URL
+// will use the proxy from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables.
+func Proxy(proxyURL string) (ProxyFunc, error) {
+	if proxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url %s: %v", proxyURL, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %s, expected one of http, https, socks5, socks5h", u.Scheme)
+	}
+	return http.ProxyURL(u), nil
+}
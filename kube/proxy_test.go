@@ -0,0 +1,201 @@
+package kube
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+// testHTTPProxy is a forward proxy supporting CONNECT tunnels and plain http
+// requests, that counts the requests it proxies.
+type testHTTPProxy struct {
+	requests int32
+}
+
+func (p *testHTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&p.requests, 1)
+	if r.Method != http.MethodConnect {
+		r.RequestURI = ""
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	pipe(conn, upstream)
+}
+
+// testSOCKS5Proxy serves the no authentication CONNECT subset of SOCKS5 and
+// counts the connections it proxies.
+type testSOCKS5Proxy struct {
+	listener    net.Listener
+	connections int32
+}
+
+func newTestSOCKS5Proxy(t *testing.T) *testSOCKS5Proxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	p := &testSOCKS5Proxy{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *testSOCKS5Proxy) serve(conn net.Conn) {
+	// greeting: version, number of methods, methods
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		conn.Close()
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, 0})
+	// request: version, command, reserved, address type, address, port
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		conn.Close()
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(conn, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		io.ReadFull(conn, buf[:1])
+		n := int(buf[0])
+		io.ReadFull(conn, buf[:n])
+		host = string(buf[:n])
+	default:
+		conn.Close()
+		return
+	}
+	io.ReadFull(conn, buf[:2])
+	port := binary.BigEndian.Uint16(buf[:2])
+	upstream, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return
+	}
+	atomic.AddInt32(&p.connections, 1)
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	pipe(conn, upstream)
+}
+
+func pipe(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+func testAPIServer(t *testing.T) (*httptest.Server, CAConfig) {
+	apiServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"major":"1","minor":"36","gitVersion":"v1.36.0"}`)
+	}))
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: apiServer.Certificate().Raw})
+	source, err := NewInlineCASource(base64.StdEncoding.EncodeToString(caPEM))
+	assert.NoError(t, err)
+	return apiServer, CAConfig{Source: source}
+}
+
+func TestClientHTTPProxy(t *testing.T) {
+	log.InitLogger("test", "debug")
+	apiServer, ca := testAPIServer(t)
+	defer apiServer.Close()
+	p := &testHTTPProxy{}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	proxy, err := Proxy(proxyServer.URL)
+	assert.NoError(t, err)
+	client, err := Client("token", apiServer.URL, ca, proxy, ClientOptions{})
+	assert.NoError(t, err)
+	version, err := client.Discovery().ServerVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.36.0", version.GitVersion)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&p.requests))
+}
+
+func TestClientSOCKS5Proxy(t *testing.T) {
+	log.InitLogger("test", "debug")
+	apiServer, ca := testAPIServer(t)
+	defer apiServer.Close()
+	p := newTestSOCKS5Proxy(t)
+	defer p.listener.Close()
+
+	proxy, err := Proxy("socks5://" + p.listener.Addr().String())
+	assert.NoError(t, err)
+	client, err := Client("token", apiServer.URL, ca, proxy, ClientOptions{})
+	assert.NoError(t, err)
+	version, err := client.Discovery().ServerVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.36.0", version.GitVersion)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&p.connections))
+}
+
+func TestURLCASourceProxy(t *testing.T) {
+	log.InitLogger("test", "debug")
+	caServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, "ca")
+	}))
+	defer caServer.Close()
+	p := &testHTTPProxy{}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	proxy, err := Proxy(proxyServer.URL)
+	assert.NoError(t, err)
+	body, err := NewURLCASource(caServer.URL, nil, proxy).fetch()
+	assert.NoError(t, err)
+	assert.Equal(t, "ca", string(body))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&p.requests))
+}
+
+func TestProxyValidation(t *testing.T) {
+	_, err := Proxy("ftp://proxy:21")
+	assert.Error(t, err)
+	proxy, err := Proxy("")
+	assert.NoError(t, err)
+	assert.NotNil(t, proxy)
+}
@@ -1,16 +1,154 @@
 package log
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
 	hclog "github.com/hashicorp/go-hclog"
 )
 
-// Logger - Application wide logger obj
-var Logger hclog.Logger
+// Names of the component loggers
+const (
+	ComponentPodWatcher = "podwatcher"
+	ComponentStore      = "store"
+	ComponentCalico     = "calico"
+	ComponentHTTP       = "http"
+	ComponentWebhook    = "webhook"
+	ComponentAudit      = "audit"
+)
+
+var (
+	// Logger - Application wide logger obj
+	Logger hclog.Logger
+	// PodWatcher, Store, Calico, HTTP, Webhook and Audit are the loggers of
+	// the components, named after the application logger, with levels of
+	// their own
+	PodWatcher hclog.Logger
+	Store      hclog.Logger
+	Calico     hclog.Logger
+	HTTP       hclog.Logger
+	Webhook    hclog.Logger
+	Audit      hclog.Logger
+
+	mu         sync.Mutex
+	components map[string]hclog.Logger
+)
+
+// Options configures the application logger
+type Options struct {
+	// Level is the level of the application logger and the default level
+	// of the components
+	Level string
+	// Levels holds the levels of individual components
+	Levels map[string]string
+	// JSON switches the output to one JSON object per line
+	JSON   bool
+	Output io.Writer
+}
 
 // InitLogger - a logger for application wide use
 func InitLogger(name, logLevel string) {
-	Logger = hclog.New(&hclog.LoggerOptions{
-		Name:  name,
-		Level: hclog.LevelFromString(logLevel),
+	if err := Init(name, Options{Level: logLevel}); err != nil {
+		panic(err)
+	}
+}
+
+// Init sets up the application logger and the component loggers
+func Init(name string, opts Options) error {
+	level, err := parseLevel(opts.Level)
+	if err != nil {
+		return err
+	}
+	output := opts.Output
+	if output == nil {
+		output = os.Stderr
+	}
+	root := hclog.New(&hclog.LoggerOptions{
+		Name:              name,
+		Level:             level,
+		JSONFormat:        opts.JSON,
+		Output:            output,
+		IndependentLevels: true,
 	})
+	named := map[string]hclog.Logger{
+		ComponentPodWatcher: root.Named(ComponentPodWatcher),
+		ComponentStore:      root.Named(ComponentStore),
+		ComponentCalico:     root.Named(ComponentCalico),
+		ComponentHTTP:       root.Named(ComponentHTTP),
+		ComponentWebhook:    root.Named(ComponentWebhook),
+		ComponentAudit:      root.Named(ComponentAudit),
+	}
+	for component, l := range opts.Levels {
+		logger, ok := named[component]
+		if !ok {
+			return fmt.Errorf("unknown log component %q", component)
+		}
+		level, err := parseLevel(l)
+		if err != nil {
+			return err
+		}
+		logger.SetLevel(level)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	Logger = root
+	PodWatcher = named[ComponentPodWatcher]
+	Store = named[ComponentStore]
+	Calico = named[ComponentCalico]
+	HTTP = named[ComponentHTTP]
+	Webhook = named[ComponentWebhook]
+	Audit = named[ComponentAudit]
+	components = named
+	return nil
+}
+
+// Components returns the names of the component loggers
+func Components() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(components))
+	for name := range components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetLevel changes the level of a component logger at runtime
+func SetLevel(component, level string) error {
+	l, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	logger, ok := components[component]
+	if !ok {
+		return fmt.Errorf("unknown log component %q", component)
+	}
+	logger.SetLevel(l)
+	return nil
+}
+
+// Levels returns the current level of each component logger
+func Levels() map[string]string {
+	mu.Lock()
+	defer mu.Unlock()
+	levels := make(map[string]string, len(components))
+	for name, logger := range components {
+		levels[name] = logger.GetLevel().String()
+	}
+	return levels
+}
+
+func parseLevel(level string) (hclog.Level, error) {
+	l := hclog.LevelFromString(level)
+	if l == hclog.NoLevel {
+		return l, fmt.Errorf("invalid log level %q", level)
+	}
+	return l, nil
 }
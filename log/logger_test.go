@@ -0,0 +1,52 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComponentLevels(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, Init("test", Options{
+		Level:  "info",
+		Levels: map[string]string{ComponentStore: "debug"},
+		JSON:   true,
+		Output: &buf,
+	}))
+	assert.Equal(t, map[string]string{
+		ComponentPodWatcher: "info",
+		ComponentStore:      "debug",
+		ComponentCalico:     "info",
+		ComponentHTTP:       "info",
+		ComponentWebhook:    "info",
+		ComponentAudit:      "info",
+	}, Levels())
+
+	Store.Debug("store message", "id", "set")
+	Calico.Debug("calico message")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 1, len(lines))
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "test.store", entry["@module"])
+	assert.Equal(t, "store message", entry["@message"])
+	assert.Equal(t, "set", entry["id"])
+
+	// Levels change independently at runtime
+	buf.Reset()
+	assert.NoError(t, SetLevel(ComponentCalico, "debug"))
+	Calico.Debug("calico message")
+	Logger.Debug("root message")
+	PodWatcher.Debug("podwatcher message")
+	assert.Contains(t, buf.String(), "calico message")
+	assert.NotContains(t, buf.String(), "root message")
+	assert.NotContains(t, buf.String(), "podwatcher message")
+
+	assert.Error(t, SetLevel("unknown", "debug"))
+	assert.Error(t, SetLevel(ComponentCalico, "loud"))
+	assert.Error(t, Init("test", Options{Level: "info", Levels: map[string]string{"unknown": "debug"}}))
+}
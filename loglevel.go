@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+// logLevelsHandler serves the current level of each component logger as JSON
+func logLevelsHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, log.Levels())
+}
+
+// LogLevelRequest is the body of a request to change the level of a component
+// logger
+type LogLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// setLogLevelHandler changes the level of a component logger at runtime
+func setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	component := r.PathValue("component")
+	var req LogLevelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if err := log.SetLevel(component, req.Level); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	log.HTTP.Info("Log level changed", "component", component, "level", req.Level, "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, log.Levels())
+}
+
+// requireToken only lets through requests that carry the token as a bearer
+// token. All requests are refused if the token is empty.
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "no token configured"})
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		given, ok := strings.CutPrefix(auth, "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			log.HTTP.Warn("Unauthorized request", "path", r.URL.Path, "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next(w, r)
+	}
+}
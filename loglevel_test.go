@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+func TestSetLogLevelHandler(t *testing.T) {
+	log.InitLogger("test", "info")
+	sm := http.NewServeMux()
+	sm.HandleFunc("GET /log/levels", logLevelsHandler)
+	sm.HandleFunc("PUT /log/levels/{component}", requireToken("secret", setLogLevelHandler))
+
+	request := func(token, component, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/log/levels/"+component, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		sm.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request("", "store", `{"level":"debug"}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("wrong", "store", `{"level":"debug"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request("secret", "unknown", `{"level":"debug"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request("secret", "store", `{"level":"loud"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request("secret", "store", `debug`).Code)
+	assert.Equal(t, "info", log.Levels()["store"])
+
+	rec := request("secret", "store", `{"level":"debug"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "debug", log.Levels()["store"])
+	assert.Equal(t, "info", log.Levels()["calico"])
+
+	rec = httptest.NewRecorder()
+	sm.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/log/levels", nil))
+	var levels map[string]string
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&levels))
+	assert.Equal(t, "debug", levels["store"])
+
+	// Runtime changes are refused without a configured token
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/log/levels/store", strings.NewReader(`{"level":"info"}`))
+	req.Header.Set("Authorization", "Bearer ")
+	requireToken("", setLogLevelHandler)(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestParseLogLevels(t *testing.T) {
+	levels, err := parseLogLevels("store=debug, calico = warn")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"store": "debug", "calico": "warn"}, levels)
+	_, err = parseLogLevels("store")
+	assert.Error(t, err)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runLookup implements the lookup subcommand, which asks a running operator
+// which remote pods and sets own an ip, now and recently.
+func runLookup(args []string) int {
+	fs := flag.NewFlagSet("lookup", flag.ContinueOnError)
+	addr := fs.String("addr", getEnv("SP_ADDR", "http://localhost:8080"), "Address of the operator http server")
+	tokenFile := fs.String("token-file", getEnv("SP_API_TOKEN_FILE", ""), "Path of a file with the bearer token of the operator -api-token-file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s lookup [flags] <ip>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	token, err := readTokenFile(*tokenFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot read token file: %v\n", err)
+		return 1
+	}
+	result, err := lookupIP(*addr, token, fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lookup failed: %v\n", err)
+		return 1
+	}
+	printLookup(os.Stdout, result)
+	if result.Current == nil && len(result.History) == 0 {
+		return 1
+	}
+	return 0
+}
+
+func lookupIP(addr, token, ip string) (IPLookup, error) {
+	var result IPLookup
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/lookup/%s", strings.TrimSuffix(addr, "/"), url.PathEscape(ip)), nil)
+	if err != nil {
+		return result, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(resp.Body)
+		return result, fmt.Errorf("unexpected response %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result, fmt.Errorf("cannot decode response: %v", err)
+	}
+	return result, nil
+}
+
+func printLookup(w io.Writer, result IPLookup) {
+	if result.Current == nil && len(result.History) == 0 {
+		fmt.Fprintf(w, "%s is not known\n", result.IP)
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLUSTER\tNAMESPACE\tPOD\tSETS\tASSIGNED\tRELEASED")
+	assignments := result.History
+	if result.Current != nil {
+		assignments = append([]IPAssignment{*result.Current}, assignments...)
+	}
+	for _, a := range assignments {
+		released := "-"
+		if !a.Released.IsZero() {
+			released = a.Released.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", a.Cluster, a.Namespace, a.Pod, strings.Join(a.Sets, ","), a.Assigned.Format(time.RFC3339), released)
+	}
+	tw.Flush()
+}
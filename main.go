@@ -1,37 +1,101 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/utilitywarehouse/semaphore-policy/audit"
 	"github.com/utilitywarehouse/semaphore-policy/calico"
+	"github.com/utilitywarehouse/semaphore-policy/export"
 	"github.com/utilitywarehouse/semaphore-policy/kube"
 	"github.com/utilitywarehouse/semaphore-policy/log"
+	"github.com/utilitywarehouse/semaphore-policy/metrics"
+	"github.com/utilitywarehouse/semaphore-policy/tracing"
+	"github.com/utilitywarehouse/semaphore-policy/webhook"
 	"k8s.io/client-go/kubernetes"
 )
 
 const (
+	labelPrefix          = "policy.semaphore.uw.io/"
 	labelManagedBy       = "managed-by"
 	valueManagedBy       = "semaphore-policy"
 	labelNetSetCluster   = "policy.semaphore.uw.io/cluster"
 	labelNetSetName      = "policy.semaphore.uw.io/name"
 	labelNetSetNamespace = "policy.semaphore.uw.io/namespace"
+	labelNetSetScope     = "policy.semaphore.uw.io/scope"
+	valueScopeNamespace  = "namespace"
+	labelNamespaceExport = "policy.semaphore.uw.io/export"
+	annotationExclude    = "policy.semaphore.uw.io/exclude"
 )
 
 var (
 	flagKubeConfigPath       = flag.String("local-kube-config", getEnv("SP_LOCAL_KUBE_CONFIG", ""), "Path of the local kube cluster config file, if not provided the app will try to get in cluster config")
+	flagKubeContext          = flag.String("local-kube-context", getEnv("SP_LOCAL_KUBE_CONTEXT", ""), "Context of the local kube config file to use, defaults to the current context")
+	flagTargetKubeContext    = flag.String("target-kube-context", getEnv("SP_TARGET_KUBE_CONTEXT", ""), "Context of the target kube config file to use, defaults to the current context")
+	flagLocalQPS             = flag.Float64("local-qps", 20, "Maximum sustained queries per second to the local cluster API")
+	flagLocalBurst           = flag.Int("local-burst", 40, "Maximum burst of queries to the local cluster API")
+	flagLocalTimeout         = flag.Duration("local-timeout", 30*time.Second, "Timeout of each request to the local cluster API")
+	flagRemoteQPS            = flag.Float64("remote-qps", 5, "Maximum sustained queries per second to the remote cluster API")
+	flagRemoteBurst          = flag.Int("remote-burst", 10, "Maximum burst of queries to the remote cluster API")
 	flagTargetKubeConfigPath = flag.String("target-kube-config", getEnv("SP_TARGET_KUBE_CONFIG", ""), "(Required) Path of the target cluster kube config file to watch pods")
 	flagLogLevel             = flag.String("log-level", getEnv("SP_LOG_LEVEL", "info"), "Log level")
+	flagLogLevels            = flag.String("log-levels", getEnv("SP_LOG_LEVELS", ""), "Comma separated list of component=level pairs to override the log level of the podwatcher, store, calico, http, webhook and audit components")
+	flagLogFormat            = flag.String("log-format", getEnv("SP_LOG_FORMAT", "text"), "Log format, text or json")
+	flagAPITokenFile         = flag.String("api-token-file", getEnv("SP_API_TOKEN_FILE", ""), "Path of a file with the bearer token required by the debug, lookup and set api endpoints, which expose the remote pods. The endpoints are disabled if not set")
+	flagLogLevelTokenFile    = flag.String("log-level-token-file", getEnv("SP_LOG_LEVEL_TOKEN_FILE", ""), "Path of a file with the bearer token required to change log levels at runtime. Runtime changes are disabled if not set")
 	flagRemoteAPIURL         = flag.String("remote-api-url", getEnv("SP_REMOTE_API_URL", ""), "Remote Kubernetes API server URL")
 	flagRemoteCAURL          = flag.String("remote-ca-url", getEnv("SP_REMOTE_CA_URL", ""), "Remote Kubernetes CA certificate URL")
+	flagRemoteCAFile         = flag.String("remote-ca-file", getEnv("SP_REMOTE_CA_FILE", ""), "Path of the remote Kubernetes CA certificate file, alternative to -remote-ca-url")
+	flagRemoteCAData         = flag.String("remote-ca-data", getEnv("SP_REMOTE_CA_DATA", ""), "Base64 encoded remote Kubernetes CA certificate, alternative to -remote-ca-url")
+	flagRemoteCARefresh      = flag.Duration("remote-ca-refresh-period", time.Hour, "Period to refresh the cached remote Kubernetes CA certificate. Zero only refreshes on verification failures")
+	flagRemoteCAURLCAFile    = flag.String("remote-ca-url-ca-file", getEnv("SP_REMOTE_CA_URL_CA_FILE", ""), "Path of a CA bundle to verify -remote-ca-url against when fetched over https, instead of the system roots")
+	flagRemoteCAPins         = flag.String("remote-ca-fingerprints", getEnv("SP_REMOTE_CA_FINGERPRINTS", ""), "Comma separated list of hex encoded SHA-256 fingerprints of the remote CA certificates to trust")
+	flagRemoteSPKIPins       = flag.String("remote-spki-fingerprints", getEnv("SP_REMOTE_SPKI_FINGERPRINTS", ""), "Comma separated list of hex encoded SHA-256 fingerprints of the remote API server certificate public key to accept")
+	flagRemoteProxyURL       = flag.String("remote-proxy-url", getEnv("SP_REMOTE_PROXY_URL", ""), "URL of a http, https or socks5 proxy for connections to the remote cluster API and CA. Defaults to the HTTPS_PROXY/HTTP_PROXY environment variables")
 	flagRemoteSATokenPath    = flag.String("remote-sa-token-path", getEnv("SP_REMOTE_SERVICE_ACCOUNT_TOKEN_PATH", ""), "Remote Kubernetes cluster token path")
 	flagPodResyncPeriod      = flag.Duration("pod-resync-period", 0, "Pod watcher cache resync period. Disabled by default")
+	flagNamespaceSets        = flag.Bool("namespace-sets", getEnv("SP_NAMESPACE_SETS", "") == "true", "Watch remote namespaces labelled with policy.semaphore.uw.io/export=true and create a network set with all their pods")
+	flagPropagatePodLabels   = flag.String("propagate-pod-labels", getEnv("SP_PROPAGATE_POD_LABELS", ""), "Comma separated list of remote pod labels to copy onto the network sets. A label is left out of a set when its pods disagree on its value")
+	flagPropagateNsLabels    = flag.String("propagate-namespace-labels", getEnv("SP_PROPAGATE_NAMESPACE_LABELS", ""), "Comma separated list of remote namespace labels to copy onto the network sets of the namespace")
+	flagNamespaceAllowList   = flag.String("namespace-allow-list", getEnv("SP_NAMESPACE_ALLOW_LIST", ""), "Comma separated list of remote namespaces to export pods from. All namespaces are allowed if empty")
+	flagNamespaceDenyList    = flag.String("namespace-deny-list", getEnv("SP_NAMESPACE_DENY_LIST", ""), "Comma separated list of remote namespaces to never export pods from. Takes precedence over the allow list")
+	flagWatchNamespaces      = flag.String("watch-namespaces", getEnv("SP_WATCH_NAMESPACES", ""), "Comma separated list of remote namespaces to watch pods in, instead of watching cluster wide. Allows the remote service account to use namespaced Roles")
+	flagMaxWatchStaleness    = flag.Duration("max-watch-staleness", 15*time.Minute, "Maximum time since the last event or bookmark of a watch before the operator is reported as not ready. Zero disables the check")
+	flagMaxSyncStall         = flag.Duration("max-sync-stall", 5*time.Minute, "Maximum time the sync loop can spend on a single task before the operator is reported as not ready. Zero disables the check")
+	flagCacheSyncTimeout     = flag.Duration("cache-sync-timeout", 5*time.Minute, "Time to wait for the watcher caches to sync on startup before applying the cache sync policy. Zero waits forever")
+	flagCacheSyncPolicy      = flag.String("cache-sync-policy", getEnv("SP_CACHE_SYNC_POLICY", cacheSyncPolicyRetry), "Action when the startup cache sync times out: 'fail' exits, 'retry' keeps the existing network sets and keeps waiting")
+	flagDeletionProtection   = flag.Bool("deletion-protection", getEnv("SP_DELETION_PROTECTION", "") == "true", "Hold back removals from the network sets while the remote cluster is unhealthy, and apply large removals gradually")
+	flagDeletionMaxSet       = flag.Float64("deletion-max-set-fraction", 0.5, "Fraction of the nets of a set that can be removed at once with deletion protection, without confirmation")
+	flagDeletionMaxTotal     = flag.Float64("deletion-max-total-fraction", 0.2, "Fraction of the nets of all sets that can be pending removal at once with deletion protection, without confirmation")
+	flagDeletionStep         = flag.Duration("deletion-step-interval", time.Minute, "Interval between the steps of gradual removals with deletion protection")
+	flagRemovalHoldDown      = flag.Duration("removal-hold-down", 0, "Time to keep the ips of departed pods in the network sets, to let connections drain and avoid flapping on fast reschedules. Disabled by default")
+	flagSetMetricsLimit      = flag.Int("set-metrics-limit", 1000, "Maximum number of network sets to export the number of nets of as metrics, to cap the metrics cardinality")
+	flagEvents               = flag.Bool("events", getEnv("SP_EVENTS", "false") == "true", "Record Kubernetes events on the local cluster for changes to the network sets and repeated sync failures")
+	flagEventsNamespace      = flag.String("events-namespace", getEnv("SP_EVENTS_NAMESPACE", ""), "Local namespace to record events in. Defaults to the namespace named after the remote namespace of each set, or the namespace of the operator if that does not exist")
+	flagEventBurst           = flag.Int("event-burst", 5, "Maximum burst of events recorded for a network set")
+	flagEventRefillPeriod    = flag.Duration("event-refill-period", time.Minute, "Period to allow one more event for a network set after a burst")
+	flagFullSyncPeriod       = flag.Duration("full-sync-period", time.Hour, "Interval of the full syncs of all the network sets after the initial one, which revert changes made outside of the operator. Zero disables them")
+	flagIPHistorySize        = flag.Int("ip-history-size", 10000, "Number of past ip assignments to remote pods kept for ip lookups. Zero disables the history")
+	flagAuditLog             = flag.String("audit-log", getEnv("SP_AUDIT_LOG", ""), "Path of the file to append audit entries of the network set membership changes to, or - for stdout. Disabled if empty")
+	flagAuditLogMaxSize      = flag.Int("audit-log-max-size", 100, "Size in megabytes of the audit log file before it is rotated")
+	flagAuditLogMaxBackups   = flag.Int("audit-log-max-backups", 10, "Number of rotated audit log files to keep")
+	flagWebhooksConfig       = flag.String("webhooks-config", getEnv("SP_WEBHOOKS_CONFIG", ""), "Path of a YAML or JSON file with the webhooks to notify of the changes to the network sets")
+	flagExportDir            = flag.String("export-dir", getEnv("SP_EXPORT_DIR", ""), "Path of a directory to export the network sets to as files, for consumers outside of Kubernetes. Disabled if empty")
+	flagExportFormat         = flag.String("export-format", getEnv("SP_EXPORT_FORMAT", string(export.FormatCIDR)), "Format of the exported files: cidr, json, ipset or nftables")
+	flagExportHook           = flag.String("export-hook", getEnv("SP_EXPORT_HOOK", ""), "Command to run with /bin/sh after the exported files change")
+	flagExportHookTimeout    = flag.Duration("export-hook-timeout", time.Minute, "Time to wait for the export hook command before killing it")
+	flagTracing              = flag.Bool("tracing", getEnv("SP_TRACING", "") == "true", "Export traces over OTLP, configured by the standard OTEL_EXPORTER_OTLP_* environment variables")
 	flagTargetCluster        = flag.String("target-cluster-name", getEnv("SP_TARGET_CLUSTER_NAME", ""), "(required) The name of the cluster from which pods are synced as networksets. It will also be used as a prefix used when creating network sets.")
 
 	saToken  = os.Getenv("SP_REMOTE_SERVICE_ACCOUNT_TOKEN")
@@ -51,13 +115,122 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
+// readTokenFile returns the bearer token in the file at path, or an empty
+// token if path is empty
+func readTokenFile(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// splitList returns the non empty items of a comma separated list
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newAuditLog returns an audit logger writing to stdout for "-", or to a
+// rotating file
+func newAuditLog(path string, maxSizeMB, maxBackups int) (*audit.Logger, error) {
+	if path == "-" {
+		return audit.New(os.Stdout), nil
+	}
+	return audit.NewFile(path, int64(maxSizeMB)*1024*1024, maxBackups)
+}
+
+// parseLogLevels parses a comma separated list of component=level pairs
+func parseLogLevels(s string) (map[string]string, error) {
+	levels := make(map[string]string)
+	for _, item := range splitList(s) {
+		component, level, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected component=level, got %q", item)
+		}
+		levels[strings.TrimSpace(component)] = strings.TrimSpace(level)
+	}
+	return levels, nil
+}
+
+// remoteCASource returns the source of the remote CA from the one flag that is
+// set among the remote CA flags
+func remoteCASource(proxy kube.ProxyFunc) (*kube.CASource, error) {
+	var sources []*kube.CASource
+	if *flagRemoteCAURL != "" {
+		var roots *x509.CertPool
+		if *flagRemoteCAURLCAFile != "" {
+			var err error
+			if roots, err = kube.LoadCertPool(*flagRemoteCAURLCAFile); err != nil {
+				return nil, err
+			}
+		}
+		sources = append(sources, kube.NewURLCASource(*flagRemoteCAURL, roots, proxy))
+	}
+	if *flagRemoteCAFile != "" {
+		sources = append(sources, kube.NewFileCASource(*flagRemoteCAFile))
+	}
+	if *flagRemoteCAData != "" {
+		source, err := kube.NewInlineCASource(*flagRemoteCAData)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	if len(sources) != 1 {
+		return nil, fmt.Errorf("exactly one of -remote-ca-url, -remote-ca-file and -remote-ca-data must be set")
+	}
+	return sources[0], nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "lookup" {
+		os.Exit(runLookup(os.Args[2:]))
+	}
 	flag.Parse()
-	log.InitLogger("semaphore-policy", *flagLogLevel)
+	logLevels, err := parseLogLevels(*flagLogLevels)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid log levels: %v\n", err)
+		os.Exit(1)
+	}
+	if *flagLogFormat != "text" && *flagLogFormat != "json" {
+		fmt.Fprintf(os.Stderr, "Invalid log format: %s\n", *flagLogFormat)
+		os.Exit(1)
+	}
+	if err := log.Init("semaphore-policy", log.Options{
+		Level:  *flagLogLevel,
+		Levels: logLevels,
+		JSON:   *flagLogFormat == "json",
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot set up logging: %v\n", err)
+		os.Exit(1)
+	}
+	logLevelToken, err := readTokenFile(*flagLogLevelTokenFile)
+	if err != nil {
+		log.Logger.Error("Cannot read log level token file", "path", *flagLogLevelTokenFile, "err", err)
+		os.Exit(1)
+	}
+	apiToken, err := readTokenFile(*flagAPITokenFile)
+	if err != nil {
+		log.Logger.Error("Cannot read api token file", "path", *flagAPITokenFile, "err", err)
+		os.Exit(1)
+	}
 	if *flagTargetCluster == "" {
 		log.Logger.Error("Must specify non-empty target cluster naeme for the created globalnetworksets")
 		usage()
 	}
+	if *flagIPHistorySize < 0 {
+		log.Logger.Error("ip history size must not be negative", "size", *flagIPHistorySize)
+		usage()
+	}
 	if *flagRemoteSATokenPath != "" {
 		data, err := ioutil.ReadFile(*flagRemoteSATokenPath)
 		if err != nil {
@@ -77,7 +250,22 @@ func main() {
 		}
 	}
 
-	homeCalicoClient, err := calico.ClientFromConfig(*flagKubeConfigPath)
+	metrics.SetNetworkSetNetsLimit(*flagSetMetricsLimit)
+	shutdownTracing := func(context.Context) error { return nil }
+	if *flagTracing {
+		var err error
+		shutdownTracing, err = tracing.Init(context.Background(), "semaphore-policy")
+		if err != nil {
+			log.Logger.Error("Failed to set up tracing", "err", err)
+			os.Exit(1)
+		}
+	}
+	calico.SetRequestTimeout(*flagLocalTimeout)
+	homeCalicoClient, err := calico.ClientFromConfig(*flagKubeConfigPath, *flagKubeContext, kube.ClientOptions{
+		QPS:     float32(*flagLocalQPS),
+		Burst:   *flagLocalBurst,
+		Timeout: *flagLocalTimeout,
+	})
 	if err != nil {
 		log.Logger.Error(
 			"cannot create kube client for homecluster",
@@ -85,11 +273,35 @@ func main() {
 		)
 		usage()
 	}
+	remoteProxy, err := kube.Proxy(*flagRemoteProxyURL)
+	if err != nil {
+		log.Logger.Error("invalid remote proxy", "err", err)
+		usage()
+	}
+	// The remote client is used for watches, so no timeout is set
+	remoteOpts := kube.ClientOptions{
+		QPS:   float32(*flagRemoteQPS),
+		Burst: *flagRemoteBurst,
+	}
 	var remoteClient *kubernetes.Clientset
 	if *flagTargetKubeConfigPath != "" {
-		remoteClient, err = kube.ClientFromConfig(*flagTargetKubeConfigPath)
+		// Only override the kubeconfig proxy when explicitly configured
+		var proxy kube.ProxyFunc
+		if *flagRemoteProxyURL != "" {
+			proxy = remoteProxy
+		}
+		remoteClient, err = kube.ClientFromConfig(*flagTargetKubeConfigPath, *flagTargetKubeContext, proxy, remoteOpts)
 	} else {
-		remoteClient, err = kube.Client(saToken, *flagRemoteAPIURL, *flagRemoteCAURL)
+		var caSource *kube.CASource
+		caSource, err = remoteCASource(remoteProxy)
+		if err == nil {
+			remoteClient, err = kube.Client(saToken, *flagRemoteAPIURL, kube.CAConfig{
+				Source:           caSource,
+				RefreshPeriod:    *flagRemoteCARefresh,
+				CAFingerprints:   splitList(*flagRemoteCAPins),
+				SPKIFingerprints: splitList(*flagRemoteSPKIPins),
+			}, remoteProxy, remoteOpts)
+		}
 	}
 	if err != nil {
 		log.Logger.Error(
@@ -99,35 +311,143 @@ func main() {
 		usage()
 	}
 
+	cacheSync := cacheSyncConfig{
+		timeout: *flagCacheSyncTimeout,
+		policy:  *flagCacheSyncPolicy,
+	}
+	if err := cacheSync.validate(); err != nil {
+		log.Logger.Error("invalid cache sync settings", "err", err)
+		usage()
+	}
+
+	protection := deletionProtectionConfig{
+		enabled:          *flagDeletionProtection,
+		maxSetFraction:   *flagDeletionMaxSet,
+		maxTotalFraction: *flagDeletionMaxTotal,
+		stepInterval:     *flagDeletionStep,
+	}
+	if err := protection.validate(); err != nil {
+		log.Logger.Error("invalid deletion protection settings", "err", err)
+		usage()
+	}
+
 	r := newRunner(
 		homeCalicoClient,
 		remoteClient,
 		*flagTargetCluster,
 		*flagPodResyncPeriod,
+		*flagNamespaceSets,
+		splitList(*flagPropagatePodLabels),
+		splitList(*flagPropagateNsLabels),
+		namespaceFilter{
+			allow: splitList(*flagNamespaceAllowList),
+			deny:  splitList(*flagNamespaceDenyList),
+		},
+		splitList(*flagWatchNamespaces),
+		cacheSync,
+		protection,
+		*flagRemovalHoldDown,
+		*flagIPHistorySize,
 	)
-	if err := r.Start(); err != nil {
-		log.Logger.Error("Failed to start runner", "err", err)
-		os.Exit(1)
+	r.fullSyncPeriod = *flagFullSyncPeriod
+
+	if *flagEvents {
+		if *flagEventBurst <= 0 || *flagEventRefillPeriod <= 0 {
+			log.Logger.Error("event burst and refill period must be positive")
+			usage()
+		}
+		localClient, err := kube.ClientFromConfig(*flagKubeConfigPath, *flagKubeContext, nil, kube.ClientOptions{
+			QPS:     float32(*flagLocalQPS),
+			Burst:   *flagLocalBurst,
+			Timeout: *flagLocalTimeout,
+		})
+		if err != nil {
+			log.Logger.Error("cannot create kube client for events", "err", err)
+			usage()
+		}
+		r.nsStore.events = newSetEvents(localClient, *flagEventsNamespace, os.Getenv("POD_NAMESPACE"), *flagEventBurst, float32(1/flagEventRefillPeriod.Seconds()))
 	}
 
-	sm := http.NewServeMux()
-	sm.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
-		if r.Healthy() {
-			w.WriteHeader(http.StatusOK)
-		} else {
-			w.WriteHeader(http.StatusServiceUnavailable)
+	if *flagAuditLog != "" {
+		auditLog, err := newAuditLog(*flagAuditLog, *flagAuditLogMaxSize, *flagAuditLogMaxBackups)
+		if err != nil {
+			log.Logger.Error("Cannot open audit log", "err", err)
+			os.Exit(1)
 		}
-	})
+		defer auditLog.Close()
+		r.nsStore.audit = auditLog
+	}
+
+	if *flagWebhooksConfig != "" {
+		configs, err := webhook.LoadConfig(*flagWebhooksConfig)
+		if err != nil {
+			log.Logger.Error("Invalid webhooks config", "err", err)
+			os.Exit(1)
+		}
+		webhooks, err := webhook.New(configs)
+		if err != nil {
+			log.Logger.Error("Invalid webhooks config", "err", err)
+			os.Exit(1)
+		}
+		webhooks.Start()
+		defer webhooks.Stop()
+		r.nsStore.webhooks = webhooks
+	}
+
+	if *flagExportDir != "" {
+		format, err := export.ParseFormat(*flagExportFormat)
+		if err != nil {
+			log.Logger.Error("Invalid export format", "err", err)
+			usage()
+		}
+		exporter, err := export.New(*flagExportDir, format, *flagExportHook, *flagExportHookTimeout)
+		if err != nil {
+			log.Logger.Error("Cannot export network sets", "err", err)
+			os.Exit(1)
+		}
+		exporter.Start()
+		defer exporter.Stop()
+		stopExport := make(chan struct{})
+		defer close(stopExport)
+		go runExport(r.nsStore.feed, exporter, stopExport)
+	}
+
+	// Serve health endpoints while waiting for the initial sync
+	sm := http.NewServeMux()
+	sm.HandleFunc("/livez", liveHandler)
+	sm.Handle("/readyz", readyHandler(r, *flagMaxWatchStaleness, *flagMaxSyncStall))
+	// kept for backwards compatibility, same as /readyz
+	sm.Handle("/healthz", readyHandler(r, *flagMaxWatchStaleness, *flagMaxSyncStall))
 	sm.Handle("/metrics", promhttp.Handler())
+	// The debug, lookup and set endpoints expose the remote pods and share
+	// the port of the metrics, so they require a token
+	sm.Handle("GET /debug/sets", requireToken(apiToken, setsHandler(r.nsStore)))
+	sm.Handle("GET /debug/sets/{id}/diff", requireToken(apiToken, setDiffHandler(r.nsStore)))
+	sm.Handle("GET /debug/queue", requireToken(apiToken, queueHandler(r.nsStore)))
+	sm.Handle("GET /api/v1/sets", requireToken(apiToken, setListHandler(r.nsStore.feed)))
+	sm.Handle("GET /api/v1/sets/watch", requireToken(apiToken, setWatchHandler(r.nsStore.feed)))
+	sm.Handle("GET /lookup/{ip}", requireToken(apiToken, lookupHandler(r.nsStore.ipIndex)))
+	sm.HandleFunc("GET /log/levels", logLevelsHandler)
+	sm.HandleFunc("PUT /log/levels/{component}", requireToken(logLevelToken, setLogLevelHandler))
 	go func() {
-		log.Logger.Error("Listen and Serve", "err", http.ListenAndServe(":8080", sm))
+		log.HTTP.Error("Listen and Serve", "err", http.ListenAndServe(":8080", sm))
 	}()
-	quit := make(chan os.Signal, 1)
-	for {
-		select {
-		case <-quit:
-			log.Logger.Info("Quitting")
+
+	go func() {
+		if err := r.Start(); err != nil {
+			log.Logger.Error("Failed to start runner", "err", err)
+			os.Exit(1)
 		}
-	}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+	log.Logger.Info("Quitting")
 	r.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		log.Logger.Error("Failed to flush traces", "err", err)
+	}
 }
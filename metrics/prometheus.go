@@ -1,10 +1,45 @@
 package metrics
 
 import (
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// latencyBuckets cover from sub-second syncs to several minutes, with a bucket
+// at 30s to alert on
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
 var (
+	auditWriteErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "semaphore_policy_audit_write_errors_total",
+			Help: "Number of audit entries that could not be written.",
+		},
+	)
+	cacheSyncTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "semaphore_policy_cache_sync_timeouts_total",
+			Help: "Number of times waiting for a watcher cache to sync on startup timed out.",
+		},
+		[]string{"cache"},
+	)
+	cacheSyncWaiting = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "semaphore_policy_cache_sync_waiting",
+			Help: "Whether the operator is waiting for a watcher cache to sync on startup (1) or not (0).",
+		},
+		[]string{"cache"},
+	)
+	calicoClientRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "semaphore_policy_calico_client_request_duration_seconds",
+			Help:    "Duration of calico client requests.",
+			Buckets: latencyBuckets,
+		},
+		[]string{"type"},
+	)
 	calicoClientRequest = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "semaphore_policy_calico_client_request_total",
@@ -19,18 +54,144 @@ var (
 		},
 		[]string{"type"},
 	)
+	podWatcherCachedPods = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "semaphore_policy_pod_watcher_cached_pods",
+			Help: "Number of pods held in the cache of a pod watcher, by watcher and watched namespace (empty for all namespaces).",
+		},
+		[]string{"watcher", "namespace"},
+	)
+	exportErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "semaphore_policy_export_errors_total",
+			Help: "Number of failures to export network sets to files by operation (write|remove|hook).",
+		},
+		[]string{"op"},
+	)
+	fullSyncDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "semaphore_policy_full_sync_duration_seconds",
+			Help:    "Duration of full syncs of all the network sets.",
+			Buckets: latencyBuckets,
+		},
+	)
+	lastFullSync = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "semaphore_policy_last_successful_full_sync_timestamp_seconds",
+			Help: "Time of the last full sync that synced all the network sets without errors.",
+		},
+	)
+	heldDeletions = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "semaphore_policy_deletion_protection_held_nets",
+			Help: "Number of nets held back in the network sets by the deletion protection.",
+		},
+	)
+	heldDeletionSets = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "semaphore_policy_deletion_protection_held_sets",
+			Help: "Number of network sets with removals held back by the deletion protection.",
+		},
+	)
+	throttledDeletions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "semaphore_policy_deletion_protection_throttled_nets_total",
+			Help: "Number of nets removed in the steps of gradual removals.",
+		},
+	)
+	networkSets = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "semaphore_policy_network_sets",
+			Help: "Number of network sets managed for a remote cluster.",
+		},
+		[]string{"cluster"},
+	)
+	networkSetNets = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "semaphore_policy_network_set_nets",
+			Help: "Number of nets in a network set, as last written to calico. Namespace sets have an empty name. Only reported for up to the configured number of sets.",
+		},
+		[]string{"cluster", "namespace", "name"},
+	)
+	networkSetNetsDropped = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "semaphore_policy_network_set_nets_dropped_sets",
+			Help: "Number of network sets not reported by semaphore_policy_network_set_nets because of the cardinality limit.",
+		},
+	)
+	namespaceWatcherFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "semaphore_policy_namespace_watcher_failures_total",
+			Help: "Number of failed namespace watcher actions (watch|list).",
+		},
+		[]string{"type"},
+	)
+	propagatedLabelConflicts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "semaphore_policy_propagated_label_conflicts_total",
+			Help: "Number of conflicts on propagated pod labels left out of a set because the pods of the set disagree on their value, counted as they arise.",
+		},
+		[]string{"label"},
+	)
+	remoteCAFetchFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "semaphore_policy_remote_ca_fetch_failures_total",
+			Help: "Number of failed attempts to fetch the remote cluster CA bundle.",
+		},
+	)
+	remoteCAExpiry = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "semaphore_policy_remote_ca_expiry_timestamp_seconds",
+			Help: "Expiry time of the earliest expiring certificate in the last fetched remote cluster CA bundle.",
+		},
+	)
 	syncQueueFullFailures = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "semaphore_policy_sync_queue_full_failures_total",
 			Help: "Number of times a sync task was not added to the sync queue in time because the queue was full.",
 		},
 	)
+	syncLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "semaphore_policy_sync_latency_seconds",
+			Help:    "Time from a remote event changing a network set to the set being written to calico, including retries.",
+			Buckets: latencyBuckets,
+		},
+	)
 	syncRequeue = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "semaphore_policy_sync_requeue_total",
 			Help: "Number of attempts to requeue a sync.",
 		},
 	)
+	webhookDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "semaphore_policy_webhook_deliveries_total",
+			Help: "Number of webhook notifications by result (success|failure|dropped).",
+		},
+		[]string{"webhook", "result"},
+	)
+	webhookDeliveryRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "semaphore_policy_webhook_delivery_retries_total",
+			Help: "Number of retried webhook delivery attempts.",
+		},
+		[]string{"webhook"},
+	)
+	setWatchers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "semaphore_policy_set_watchers",
+			Help: "Number of clients watching the network sets.",
+		},
+	)
+	webhookDeliveryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "semaphore_policy_webhook_delivery_duration_seconds",
+			Help:    "Duration of webhook delivery attempts.",
+			Buckets: latencyBuckets,
+		},
+		[]string{"webhook"},
+	)
 )
 
 func init() {
@@ -39,15 +200,65 @@ func init() {
 	// start with a 0 value.
 	for _, t := range []string{"get", "list", "create", "update", "patch", "watch", "delete"} {
 		podWatcherFailures.With(prometheus.Labels{"type": t})
+		namespaceWatcherFailures.With(prometheus.Labels{"type": t})
 		for _, s := range []string{"0", "1"} {
 			calicoClientRequest.With(prometheus.Labels{"type": t, "success": s})
 		}
 	}
 
+	prometheus.MustRegister(auditWriteErrors)
+	prometheus.MustRegister(cacheSyncTimeouts)
+	prometheus.MustRegister(cacheSyncWaiting)
 	prometheus.MustRegister(calicoClientRequest)
+	prometheus.MustRegister(calicoClientRequestDuration)
+	prometheus.MustRegister(exportErrors)
+	prometheus.MustRegister(fullSyncDuration)
+	prometheus.MustRegister(lastFullSync)
 	prometheus.MustRegister(podWatcherFailures)
+	prometheus.MustRegister(podWatcherCachedPods)
+	prometheus.MustRegister(heldDeletions)
+	prometheus.MustRegister(heldDeletionSets)
+	prometheus.MustRegister(throttledDeletions)
+	prometheus.MustRegister(namespaceWatcherFailures)
+	prometheus.MustRegister(networkSets)
+	prometheus.MustRegister(networkSetNets)
+	prometheus.MustRegister(networkSetNetsDropped)
+	prometheus.MustRegister(propagatedLabelConflicts)
+	prometheus.MustRegister(remoteCAFetchFailures)
+	prometheus.MustRegister(remoteCAExpiry)
+	prometheus.MustRegister(setWatchers)
 	prometheus.MustRegister(syncQueueFullFailures)
 	prometheus.MustRegister(syncRequeue)
+	prometheus.MustRegister(syncLatency)
+	prometheus.MustRegister(webhookDeliveries)
+	prometheus.MustRegister(webhookDeliveryRetries)
+	prometheus.MustRegister(webhookDeliveryDuration)
+}
+
+func IncAuditWriteErrors() {
+	auditWriteErrors.Inc()
+}
+
+func IncExportErrors(op string) {
+	exportErrors.With(prometheus.Labels{
+		"op": op,
+	}).Inc()
+}
+
+func IncCacheSyncTimeouts(cache string) {
+	cacheSyncTimeouts.With(prometheus.Labels{
+		"cache": cache,
+	}).Inc()
+}
+
+func SetCacheSyncWaiting(cache string, waiting bool) {
+	v := float64(0)
+	if waiting {
+		v = 1
+	}
+	cacheSyncWaiting.With(prometheus.Labels{
+		"cache": cache,
+	}).Set(v)
 }
 
 func IncCalicoClientRequest(t string, err error) {
@@ -61,16 +272,160 @@ func IncCalicoClientRequest(t string, err error) {
 	}).Inc()
 }
 
+func SetHeldDeletions(nets, sets int) {
+	heldDeletions.Set(float64(nets))
+	heldDeletionSets.Set(float64(sets))
+}
+
+func IncThrottledDeletions(nets int) {
+	throttledDeletions.Add(float64(nets))
+}
+
+func ObserveCalicoClientRequestDuration(t string, start time.Time) {
+	calicoClientRequestDuration.With(prometheus.Labels{
+		"type": t,
+	}).Observe(time.Since(start).Seconds())
+}
+
+func ObserveFullSync(start time.Time, success bool) {
+	fullSyncDuration.Observe(time.Since(start).Seconds())
+	if success {
+		lastFullSync.SetToCurrentTime()
+	}
+}
+
+func SetNetworkSets(cluster string, sets int) {
+	networkSets.With(prometheus.Labels{
+		"cluster": cluster,
+	}).Set(float64(sets))
+}
+
+// networkSetNetsLimit caps the number of sets reported by networkSetNets,
+// which are tracked by set id
+var (
+	networkSetNetsMu     sync.Mutex
+	networkSetNetsLimit  = 1000
+	networkSetNetsLabels = make(map[string]prometheus.Labels)
+	networkSetNetsDrop   = make(map[string]bool)
+)
+
+// SetNetworkSetNetsLimit sets the maximum number of sets reported by the nets
+// per set gauge. Zero disables the gauge.
+func SetNetworkSetNetsLimit(limit int) {
+	networkSetNetsMu.Lock()
+	defer networkSetNetsMu.Unlock()
+	networkSetNetsLimit = limit
+}
+
+func SetNetworkSetNets(id, cluster, namespace, name string, nets int) {
+	networkSetNetsMu.Lock()
+	defer networkSetNetsMu.Unlock()
+	labels, ok := networkSetNetsLabels[id]
+	if !ok {
+		if len(networkSetNetsLabels) >= networkSetNetsLimit {
+			networkSetNetsDrop[id] = true
+			networkSetNetsDropped.Set(float64(len(networkSetNetsDrop)))
+			return
+		}
+		labels = prometheus.Labels{
+			"cluster":   cluster,
+			"namespace": namespace,
+			"name":      name,
+		}
+		networkSetNetsLabels[id] = labels
+	}
+	networkSetNets.With(labels).Set(float64(nets))
+}
+
+func DeleteNetworkSetNets(id string) {
+	networkSetNetsMu.Lock()
+	defer networkSetNetsMu.Unlock()
+	if labels, ok := networkSetNetsLabels[id]; ok {
+		networkSetNets.Delete(labels)
+		delete(networkSetNetsLabels, id)
+	}
+	delete(networkSetNetsDrop, id)
+	networkSetNetsDropped.Set(float64(len(networkSetNetsDrop)))
+}
+
 func IncPodWatcherFailures(t string) {
 	podWatcherFailures.With(prometheus.Labels{
 		"type": t,
 	}).Inc()
 }
 
+func IncPodWatcherCachedPods(watcher, namespace string) {
+	podWatcherCachedPods.With(prometheus.Labels{
+		"watcher":   watcher,
+		"namespace": namespace,
+	}).Inc()
+}
+
+func DecPodWatcherCachedPods(watcher, namespace string) {
+	podWatcherCachedPods.With(prometheus.Labels{
+		"watcher":   watcher,
+		"namespace": namespace,
+	}).Dec()
+}
+
+func DeletePodWatcherCachedPods(watcher, namespace string) {
+	podWatcherCachedPods.Delete(prometheus.Labels{
+		"watcher":   watcher,
+		"namespace": namespace,
+	})
+}
+
+func IncNamespaceWatcherFailures(t string) {
+	namespaceWatcherFailures.With(prometheus.Labels{
+		"type": t,
+	}).Inc()
+}
+
+func IncPropagatedLabelConflicts(label string) {
+	propagatedLabelConflicts.With(prometheus.Labels{
+		"label": label,
+	}).Inc()
+}
+
+func IncRemoteCAFetchFailures() {
+	remoteCAFetchFailures.Inc()
+}
+
+func SetRemoteCAExpiry(t time.Time) {
+	remoteCAExpiry.Set(float64(t.Unix()))
+}
+
+func SetSetWatchers(n int) {
+	setWatchers.Set(float64(n))
+}
+
 func IncSyncQueueFullFailures() {
 	syncQueueFullFailures.Inc()
 }
 
+func ObserveSyncLatency(since time.Time) {
+	syncLatency.Observe(time.Since(since).Seconds())
+}
+
 func IncSyncRequeue() {
 	syncRequeue.Inc()
 }
+
+func IncWebhookDeliveries(webhook, result string) {
+	webhookDeliveries.With(prometheus.Labels{
+		"webhook": webhook,
+		"result":  result,
+	}).Inc()
+}
+
+func IncWebhookDeliveryRetries(webhook string) {
+	webhookDeliveryRetries.With(prometheus.Labels{
+		"webhook": webhook,
+	}).Inc()
+}
+
+func ObserveWebhookDeliveryDuration(webhook string, start time.Time) {
+	webhookDeliveryDuration.With(prometheus.Labels{
+		"webhook": webhook,
+	}).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetworkSetNetsLimit(t *testing.T) {
+	SetNetworkSetNetsLimit(2)
+	defer SetNetworkSetNetsLimit(1000)
+
+	SetNetworkSetNets("a", "c1", "ns", "a", 1)
+	SetNetworkSetNets("b", "c1", "ns", "b", 2)
+	SetNetworkSetNets("c", "c1", "ns", "c", 3)
+	assert.Equal(t, 2, testutil.CollectAndCount(networkSetNets))
+	assert.Equal(t, float64(1), testutil.ToFloat64(networkSetNetsDropped))
+
+	// Updates of reported sets are not affected by the limit
+	SetNetworkSetNets("b", "c1", "ns", "b", 4)
+	assert.Equal(t, float64(4), testutil.ToFloat64(networkSetNets.WithLabelValues("c1", "ns", "b")))
+
+	// Deleted sets make room for new ones
+	DeleteNetworkSetNets("a")
+	DeleteNetworkSetNets("c")
+	SetNetworkSetNets("d", "c1", "ns", "d", 5)
+	assert.Equal(t, 2, testutil.CollectAndCount(networkSetNets))
+	assert.Equal(t, float64(0), testutil.ToFloat64(networkSetNetsDropped))
+}
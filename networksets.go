@@ -1,184 +1,1070 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	calicoClientset "github.com/projectcalico/api/pkg/client/clientset_generated/clientset"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/utilitywarehouse/semaphore-policy/audit"
 	"github.com/utilitywarehouse/semaphore-policy/calico"
 	"github.com/utilitywarehouse/semaphore-policy/log"
 	"github.com/utilitywarehouse/semaphore-policy/metrics"
+	"github.com/utilitywarehouse/semaphore-policy/tracing"
+	"github.com/utilitywarehouse/semaphore-policy/webhook"
 )
 
 type NetworkSet struct {
 	labels map[string]string
 	nets   []string
+	// netLabels holds the remote pod labels propagated by each net of the
+	// set
+	netLabels map[string]map[string]string
+	// pendingRemoval holds the nets kept in the set during the hold-down
+	// period after their pods are gone
+	pendingRemoval map[string]*holdDown
+	// netPods holds the name of the remote pod each net belongs to
+	netPods map[string]string
+	// labelConflicts holds the propagated pod labels the nets of the set
+	// disagree on, which have been reported
+	labelConflicts map[string]bool
+}
+
+// auditCause is the reason and the pod of a change to a net of a set
+type auditCause struct {
+	reason audit.Reason
+	pod    string
+}
+
+// holdDown delays the removal of a net from a set
+type holdDown struct {
+	until time.Time
+	timer *time.Timer
+	// reason is the reason of the removal, recorded once it is applied
+	reason audit.Reason
 }
 
 type SyncObject struct {
 	id string
+	// link is the span that queued the sync, which the sync span links to
+	link trace.SpanContext
 }
 
 type NetworkSetStore struct {
+	mu            sync.Mutex
 	client        *calicoClientset.Clientset
 	syncQueue     chan SyncObject
 	fullSyncQueue chan struct{}
 	stop          chan struct{}
 	store         map[string]*NetworkSet
 	cluster       string // the name of the cluster that contains targets of this set
+	// namespaceLabels holds the remote namespace labels propagated to all
+	// the sets of each namespace
+	namespaceLabels map[string]map[string]string
+	// busySince is set while the sync loop handles a task
+	busySince    time.Time
+	lastProgress time.Time
+	// protection is nil when deletions are applied right away
+	protection *deletionProtection
+	// delayed holds the ids with a delayed sync pending and the time it is
+	// due at
+	delayed map[string]time.Time
+	// queued holds the ids waiting to be picked up by the sync loop
+	queued map[string]*queuedSync
+	// removalHoldDown is the time departed nets are kept in the sets
+	removalHoldDown time.Duration
+	// changedSince holds the time of the first change of each set not
+	// synced to calico yet
+	changedSince map[string]time.Time
+	// syncedLabels and syncedNets hold the labels and nets of the sets known
+	// to exist in calico
+	syncedLabels map[string]map[string]string
+	syncedNets   map[string][]string
+	// failures counts the consecutive sync failures of each set
+	failures map[string]int
+	events   *setEvents
+	// ipIndex maps the ips of the sets back to the remote pods
+	ipIndex *ipIndex
+	// audit records every net added to or removed from the sets in calico
+	audit *audit.Logger
+	// auditCauses holds the reason and the pod of the store changes to the
+	// nets of each set, recorded once the changes reach calico
+	auditCauses map[string]map[string]auditCause
+	// webhooks are notified of the changes applied to the sets
+	webhooks *webhook.Notifier
+	// feed streams the state of the sets applied to calico to the api
+	// watchers
+	feed *setFeed
 }
 
-func newNetworkSetStore(cluster string, client *calicoClientset.Clientset) NetworkSetStore {
-	return NetworkSetStore{
-		client:        client,
-		store:         make(map[string]*NetworkSet),
-		cluster:       cluster,
-		syncQueue:     make(chan SyncObject),
-		fullSyncQueue: make(chan struct{}),
-		stop:          make(chan struct{}),
+func newNetworkSetStore(cluster string, client *calicoClientset.Clientset) *NetworkSetStore {
+	return &NetworkSetStore{
+		client:          client,
+		store:           make(map[string]*NetworkSet),
+		cluster:         cluster,
+		namespaceLabels: make(map[string]map[string]string),
+		syncQueue:       make(chan SyncObject),
+		fullSyncQueue:   make(chan struct{}),
+		stop:            make(chan struct{}),
+		delayed:         make(map[string]time.Time),
+		queued:          make(map[string]*queuedSync),
+		changedSince:    make(map[string]time.Time),
+		feed:            newSetFeed(),
 	}
 }
 
-func (nss *NetworkSetStore) addNetworkSet(id, name, namespace, net string) *NetworkSet {
-	labels := map[string]string{
-		labelManagedBy:       valueManagedBy,
-		labelNetSetCluster:   nss.cluster,
-		labelNetSetName:      name,
-		labelNetSetNamespace: namespace,
-	}
+func (nss *NetworkSetStore) addNetworkSet(id string, labels map[string]string, net, pod string) *NetworkSet {
 	ns := &NetworkSet{
-		labels: labels,
-		nets:   []string{net},
+		labels:         labels,
+		nets:           []string{net},
+		netLabels:      make(map[string]map[string]string),
+		pendingRemoval: make(map[string]*holdDown),
+		netPods:        map[string]string{net: pod},
 	}
 	nss.store[id] = ns
 	return ns
 }
 
-func (nss *NetworkSetStore) deleteNetworkSet(id string) {
-	if _, ok := nss.store[id]; !ok {
+func (nss *NetworkSetStore) deleteNetworkSet(id string, reason audit.Reason) {
+	netset, ok := nss.store[id]
+	if !ok {
 		return
 	}
+	for _, hd := range netset.pendingRemoval {
+		hd.timer.Stop()
+	}
+	for _, net := range netset.nets {
+		nss.setAuditCause(id, net, reason, netset.netPods[net])
+		nss.ipIndex.unassign(net, id)
+	}
 	delete(nss.store, id)
 }
 
-func (nss *NetworkSetStore) AddNet(name, namespace, net string) *NetworkSet {
+// netSetLabels returns the labels of the set named after a pod label
+func (nss *NetworkSetStore) netSetLabels(name, namespace string) map[string]string {
+	return map[string]string{
+		labelManagedBy:       valueManagedBy,
+		labelNetSetCluster:   nss.cluster,
+		labelNetSetName:      name,
+		labelNetSetNamespace: namespace,
+	}
+}
+
+// namespaceNetSetLabels returns the labels of the set containing all pods of a
+// namespace
+func (nss *NetworkSetStore) namespaceNetSetLabels(namespace string) map[string]string {
+	return map[string]string{
+		labelManagedBy:       valueManagedBy,
+		labelNetSetCluster:   nss.cluster,
+		labelNetSetNamespace: namespace,
+		labelNetSetScope:     valueScopeNamespace,
+	}
+}
+
+// AddNet adds the net of a pod to the set named after a pod label. It
+// returns the ids of the sets the net was held down in, which need a sync as
+// the net has been removed from them.
+func (nss *NetworkSetStore) AddNet(name, namespace, net, pod string, reason audit.Reason) (*NetworkSet, []string) {
 	id := makeNetworkSetID(name, namespace, nss.cluster)
+	return nss.addNet(id, nss.netSetLabels(name, namespace), net, pod, reason)
+}
+
+// AddNamespaceNet adds the net of a pod to the set of the whole namespace. It
+// returns the ids of the sets the net was held down in, like AddNet.
+func (nss *NetworkSetStore) AddNamespaceNet(namespace, net, pod string, reason audit.Reason) (*NetworkSet, []string) {
+	id := makeNamespaceNetworkSetID(namespace, nss.cluster)
+	return nss.addNet(id, nss.namespaceNetSetLabels(namespace), net, pod, reason)
+}
+
+// addNet adds a net to a set and returns the ids of the sets that were
+// holding it down, from which it has been removed
+func (nss *NetworkSetStore) addNet(id string, labels map[string]string, net, pod string, reason audit.Reason) (*NetworkSet, []string) {
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+	// A net reclaimed by a pod in another set is removed from the sets
+	// holding it down right away
+	var reclaimedFrom []string
+	for otherID, other := range nss.store {
+		if _, pending := other.pendingRemoval[net]; pending && otherID != id {
+			log.Store.Debug("Net reclaimed, cancelling hold-down", "resource", otherID, "net", net, "reclaimed_by", id)
+			nss.removeNet(otherID, net, audit.ReasonTakeover)
+			reclaimedFrom = append(reclaimedFrom, otherID)
+		}
+	}
 	netset, ok := nss.store[id]
 	if !ok {
-		return nss.addNetworkSet(id, name, namespace, net)
+		nss.markChanged(id)
+		nss.ipIndex.assign(net, pod, labels[labelNetSetNamespace], id)
+		nss.setAuditCause(id, net, reason, pod)
+		return nss.addNetworkSet(id, labels, net, pod), reclaimedFrom
+	}
+	if netset.netPods == nil {
+		netset.netPods = make(map[string]string)
+	}
+	netset.netPods[net] = pod
+	nss.ipIndex.assign(net, pod, netset.labels[labelNetSetNamespace], id)
+	if hd, pending := netset.pendingRemoval[net]; pending {
+		hd.timer.Stop()
+		delete(netset.pendingRemoval, net)
 	}
 	if _, found := inSlice(netset.nets, net); !found {
 		netset.nets = append(netset.nets, net)
+		nss.markChanged(id)
+		nss.updateLabelConflicts(id, netset)
+		nss.setAuditCause(id, net, reason, pod)
 	}
 	nss.store[id] = netset
-	log.Logger.Debug("Added new net to set", "resource", id, "net", net, "set", netset.nets)
+	log.Store.Debug("Added new net to set", "resource", id, "net", net, "set", netset.nets)
+	return netset, reclaimedFrom
+}
+
+func (nss *NetworkSetStore) DeleteNet(name, namespace, net string, reason audit.Reason) *NetworkSet {
+	return nss.deleteNet(makeNetworkSetID(name, namespace, nss.cluster), net, reason)
+}
+
+// DeleteNamespaceNet removes a net from the set of the whole namespace
+func (nss *NetworkSetStore) DeleteNamespaceNet(namespace, net string, reason audit.Reason) *NetworkSet {
+	return nss.deleteNet(makeNamespaceNetworkSetID(namespace, nss.cluster), net, reason)
+}
+
+// deleteNet removes a net from a set, after the hold-down period if one is
+// configured. Nets held down stay in the set until then.
+func (nss *NetworkSetStore) deleteNet(id, net string, reason audit.Reason) *NetworkSet {
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+	netset, ok := nss.store[id]
+	if !ok {
+		return nil
+	}
+	if nss.removalHoldDown <= 0 {
+		return nss.removeNet(id, net, reason)
+	}
+	if _, found := inSlice(netset.nets, net); !found {
+		return netset
+	}
+	if _, pending := netset.pendingRemoval[net]; pending {
+		return netset
+	}
+	hd := &holdDown{until: time.Now().Add(nss.removalHoldDown), reason: reason}
+	hd.timer = time.AfterFunc(nss.removalHoldDown, func() {
+		nss.expireHoldDown(id, net, hd)
+	})
+	netset.pendingRemoval[net] = hd
+	log.Store.Debug("Holding down net removal", "resource", id, "net", net, "until", hd.until)
 	return netset
 }
 
-func (nss *NetworkSetStore) DeleteNet(name, namespace, net string) *NetworkSet {
-	id := makeNetworkSetID(name, namespace, nss.cluster)
+// expireHoldDown removes a net at the end of its hold-down period, unless the
+// hold-down was cancelled meanwhile
+func (nss *NetworkSetStore) expireHoldDown(id, net string, hd *holdDown) {
+	nss.mu.Lock()
+	netset, ok := nss.store[id]
+	if !ok || netset.pendingRemoval[net] != hd {
+		nss.mu.Unlock()
+		return
+	}
+	nss.removeNet(id, net, hd.reason)
+	nss.mu.Unlock()
+	nss.enqueue(context.Background(), id)
+}
+
+// removeNet removes a net from a set right away and must be called with the
+// lock held
+func (nss *NetworkSetStore) removeNet(id, net string, reason audit.Reason) *NetworkSet {
 	netset, ok := nss.store[id]
 	if !ok {
 		return nil
 	}
 	if i, found := inSlice(netset.nets, net); found {
 		netset.nets = removeFromSlice(netset.nets, i)
+		nss.markChanged(id)
+		nss.setAuditCause(id, net, reason, netset.netPods[net])
+	}
+	delete(netset.netLabels, net)
+	delete(netset.netPods, net)
+	nss.updateLabelConflicts(id, netset)
+	nss.ipIndex.unassign(net, id)
+	if hd, pending := netset.pendingRemoval[net]; pending {
+		hd.timer.Stop()
+		delete(netset.pendingRemoval, net)
 	}
 	nss.store[id] = netset
-	log.Logger.Debug("Deleted net from set", "resource", id, "net", net, "set", netset.nets)
+	log.Store.Debug("Deleted net from set", "resource", id, "net", net, "set", netset.nets)
 	if len(netset.nets) == 0 {
-		log.Logger.Debug("Deleting empty network set", "resource name", id)
-		nss.deleteNetworkSet(id)
+		log.Store.Debug("Deleting empty network set", "resource name", id)
+		nss.deleteNetworkSet(id, reason)
 		return nil
 	}
 	return netset
 }
 
-func (nss *NetworkSetStore) syncToCalico(id string) error {
+// DeleteNamespaceNetworkSet removes the set of the whole namespace from the
+// store, regardless of the nets it contains.
+func (nss *NetworkSetStore) DeleteNamespaceNetworkSet(namespace string) {
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+	id := makeNamespaceNetworkSetID(namespace, nss.cluster)
+	if _, ok := nss.store[id]; ok {
+		nss.markChanged(id)
+	}
+	nss.deleteNetworkSet(id, audit.ReasonDelete)
+}
+
+// SetNetLabels sets the remote pod labels to propagate for a net of a set. It
+// returns true if the labels of the net changed.
+func (nss *NetworkSetStore) SetNetLabels(name, namespace, net string, labels map[string]string) bool {
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+	netset, ok := nss.store[makeNetworkSetID(name, namespace, nss.cluster)]
+	if !ok {
+		return false
+	}
+	if _, found := inSlice(netset.nets, net); !found {
+		return false
+	}
+	if current, ok := netset.netLabels[net]; ok && equalLabels(current, labels) {
+		return false
+	}
+	netset.netLabels[net] = labels
+	nss.markChanged(makeNetworkSetID(name, namespace, nss.cluster))
+	nss.updateLabelConflicts(makeNetworkSetID(name, namespace, nss.cluster), netset)
+	return true
+}
+
+// SetNamespaceLabels sets the remote namespace labels to propagate for all the
+// sets of the namespace. It returns the ids of the sets that are affected by a
+// change.
+func (nss *NetworkSetStore) SetNamespaceLabels(namespace string, labels map[string]string) []string {
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+	if equalLabels(nss.namespaceLabels[namespace], labels) {
+		return nil
+	}
+	if nss.namespaceLabels == nil {
+		nss.namespaceLabels = make(map[string]map[string]string)
+	}
+	if len(labels) == 0 {
+		delete(nss.namespaceLabels, namespace)
+	} else {
+		nss.namespaceLabels[namespace] = labels
+	}
+	var ids []string
+	for id, netset := range nss.store {
+		if netset.labels[labelNetSetNamespace] == namespace {
+			ids = append(ids, id)
+			nss.markChanged(id)
+		}
+	}
+	return ids
+}
+
+// get returns a copy of the labels and nets of a set in the store
+func (nss *NetworkSetStore) get(id string) (map[string]string, []string, bool) {
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
 	netset, ok := nss.store[id]
 	if !ok {
-		log.Logger.Info(
+		return nil, nil, false
+	}
+	labels := nss.resolveLabels(netset)
+	nets := make([]string, len(netset.nets))
+	copy(nets, netset.nets)
+	return labels, nets, true
+}
+
+// resolveLabels returns the labels of a set, including the propagated remote
+// namespace and pod labels. A pod label is only propagated when all the nets
+// of the set carry it with the same value, otherwise it is left out.
+// Propagated pod labels take precedence over namespace ones and neither can
+// override the labels set by the operator.
+func (nss *NetworkSetStore) resolveLabels(netset *NetworkSet) map[string]string {
+	labels := make(map[string]string)
+	for k, v := range nss.namespaceLabels[netset.labels[labelNetSetNamespace]] {
+		labels[k] = v
+	}
+	agreed, _ := netset.propagatedLabels()
+	for k, v := range agreed {
+		labels[k] = v
+	}
+	for k, v := range netset.labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// labelConflict is a propagated pod label the nets of a set disagree on
+type labelConflict struct {
+	values []string
+	// missing is the number of nets without the label
+	missing int
+}
+
+// propagatedLabels returns the pod labels carried by all the nets of the set
+// with the same value, and the conflicts on the others
+func (netset *NetworkSet) propagatedLabels() (map[string]string, map[string]labelConflict) {
+	values := make(map[string][]string)
+	for _, net := range netset.nets {
+		for k, v := range netset.netLabels[net] {
+			if _, found := inSlice(values[k], v); !found {
+				values[k] = append(values[k], v)
+			}
+		}
+	}
+	agreed := make(map[string]string)
+	conflicts := make(map[string]labelConflict)
+	for k, vs := range values {
+		missing := 0
+		for _, net := range netset.nets {
+			if _, ok := netset.netLabels[net][k]; !ok {
+				missing++
+			}
+		}
+		if len(vs) > 1 || missing > 0 {
+			sort.Strings(vs)
+			conflicts[k] = labelConflict{values: vs, missing: missing}
+			continue
+		}
+		agreed[k] = vs[0]
+	}
+	return agreed, conflicts
+}
+
+// updateLabelConflicts reports the conflicts on propagated pod labels that
+// arise from a change to the nets of a set, once each, and must be called with
+// the lock held
+func (nss *NetworkSetStore) updateLabelConflicts(id string, netset *NetworkSet) {
+	_, conflicts := netset.propagatedLabels()
+	reported := make(map[string]bool, len(conflicts))
+	for k, c := range conflicts {
+		reported[k] = true
+		if netset.labelConflicts[k] {
+			continue
+		}
+		log.Store.Warn(
+			"Conflicting values for propagated pod label, leaving it out of the set",
+			"resource", id, "label", k, "values", c.values, "nets_without_label", c.missing)
+		metrics.IncPropagatedLabelConflicts(k)
+	}
+	netset.labelConflicts = reported
+}
+
+// ids returns the ids of all the sets in the store
+func (nss *NetworkSetStore) ids() []string {
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+	ids := make([]string, 0, len(nss.store))
+	for id := range nss.store {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (nss *NetworkSetStore) syncToCalico(ctx context.Context, id string) error {
+	labels, nets, ok := nss.get(id)
+	if nss.protection != nil {
+		return nss.protectedSyncToCalico(ctx, id, labels, nets, ok)
+	}
+	if !ok {
+		log.Store.Info(
 			"Could not find network set in store, will try deleting from calico",
 			"resource", id)
-		return calico.DeleteGlobalNetworkSet(nss.client, id)
+		if err := calico.DeleteGlobalNetworkSet(ctx, nss.client, id); err != nil {
+			return err
+		}
+		nss.synced(id, calico.ActionDeleted, nil, nil)
+		return nil
 	}
-	log.Logger.Info("Updating calico object", "resource", id, "nets", netset.nets)
-	return calico.CreateOrUpdateGlobalNetworkSet(
+	log.Store.Info("Updating calico object", "resource", id, "nets", nets)
+	action, err := calico.CreateOrUpdateGlobalNetworkSet(
+		ctx,
 		nss.client,
 		id,
-		netset.labels,
-		netset.nets,
+		labels,
+		nets,
 	)
+	if err != nil {
+		return err
+	}
+	nss.synced(id, action, labels, nets)
+	return nil
+}
+
+// protectedSyncToCalico syncs a set, letting the deletion protection decide
+// which of the removed nets can be dropped from calico. A set missing from the
+// store is only deleted once all its nets have been removed.
+func (nss *NetworkSetStore) protectedSyncToCalico(ctx context.Context, id string, labels map[string]string, nets []string, ok bool) error {
+	current, err := calico.GetGlobalNetworkSet(ctx, nss.client, id)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		nss.protection.forget(id)
+		if !ok {
+			nss.synced(id, calico.ActionDeleted, nil, nil)
+			return nil
+		}
+		log.Store.Info("Creating calico object", "resource", id, "nets", nets)
+		if err := calico.CreateGlobalNetworkSet(ctx, nss.client, id, labels, nets); err != nil {
+			return err
+		}
+		nss.synced(id, calico.ActionCreated, labels, nets)
+		return nil
+	}
+	confirmed := current.Annotations[annotationConfirmDeletions] == "true"
+	apply, held := nss.protection.plan(id, current.Spec.Nets, nets, confirmed)
+	if held > 0 {
+		log.Store.Warn("Holding back removals from network set", "resource", id, "held", held)
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Int("held", held))
+		nss.requeueAfter(ctx, id, nss.protection.stepInterval)
+	}
+	if !ok && len(apply) == 0 {
+		log.Store.Info("Could not find network set in store, deleting from calico", "resource", id)
+		nss.protection.forget(id)
+		if err := calico.DeleteGlobalNetworkSet(ctx, nss.client, id); err != nil {
+			return err
+		}
+		nss.synced(id, calico.ActionDeleted, nil, nil)
+		return nil
+	}
+	// a set being removed gradually keeps its labels
+	if !ok {
+		labels = current.Labels
+	}
+	clearConfirmation := confirmed && held == 0
+	if !calico.NeedsUpdate(current, labels, apply) && !clearConfirmation {
+		nss.synced(id, calico.ActionNone, labels, apply)
+		return nil
+	}
+	current.Labels = labels
+	current.Spec.Nets = apply
+	if clearConfirmation {
+		delete(current.Annotations, annotationConfirmDeletions)
+	}
+	log.Store.Info("Updating calico object", "resource", id, "nets", apply)
+	if err := calico.UpdateGlobalNetworkSet(ctx, nss.client, current); err != nil {
+		return err
+	}
+	nss.synced(id, calico.ActionUpdated, labels, apply)
+	return nil
+}
+
+// setAuditCause records the reason and the pod of a change to a net of a set,
+// to audit once the change is synced, and must be called with the lock held
+func (nss *NetworkSetStore) setAuditCause(id, net string, reason audit.Reason, pod string) {
+	if nss.audit == nil {
+		return
+	}
+	if nss.auditCauses == nil {
+		nss.auditCauses = make(map[string]map[string]auditCause)
+	}
+	if nss.auditCauses[id] == nil {
+		nss.auditCauses[id] = make(map[string]auditCause)
+	}
+	nss.auditCauses[id][net] = auditCause{reason: reason, pod: pod}
+}
+
+// auditSynced records the nets added to and removed from a set in calico by a
+// sync, with the causes of the store changes behind them. Changes without a
+// cause revert changes made outside of the operator, or remove stale sets.
+// Causes of the changes still held back, eg by the deletion protection, are
+// kept for a later sync.
+func (nss *NetworkSetStore) auditSynced(id string, labels map[string]string, nets, lastNets []string) {
+	if nss.audit == nil {
+		return
+	}
+	type entry struct {
+		action audit.Action
+		net    string
+		cause  auditCause
+	}
+	var entries []entry
+	nss.mu.Lock()
+	netset, inStore := nss.store[id]
+	causes := nss.auditCauses[id]
+	fallback := audit.ReasonDriftRevert
+	if !inStore {
+		fallback = audit.ReasonGC
+	}
+	causeOf := func(net string) auditCause {
+		if c, ok := causes[net]; ok {
+			return c
+		}
+		c := auditCause{reason: fallback}
+		if inStore {
+			c.pod = netset.netPods[net]
+		}
+		return c
+	}
+	for _, net := range nets {
+		if _, found := inSlice(lastNets, net); !found {
+			entries = append(entries, entry{audit.ActionAdded, net, causeOf(net)})
+		}
+	}
+	for _, net := range lastNets {
+		if _, found := inSlice(nets, net); !found {
+			entries = append(entries, entry{audit.ActionRemoved, net, causeOf(net)})
+		}
+	}
+	for net := range causes {
+		_, synced := inSlice(nets, net)
+		var stored bool
+		if inStore {
+			_, stored = inSlice(netset.nets, net)
+		}
+		if synced == stored {
+			delete(causes, net)
+		}
+	}
+	if len(causes) == 0 {
+		delete(nss.auditCauses, id)
+	}
+	nss.mu.Unlock()
+	for _, e := range entries {
+		if e.cause.reason == audit.ReasonDriftRevert {
+			log.Store.Warn("Reverted change to network set made outside of the operator", "resource", id, "net", e.net, "action", e.action)
+		}
+		nss.recordAudit(e.action, e.cause.reason, id, labels, e.net, e.cause.pod)
+	}
+}
+
+// recordAudit records a net added to or removed from a set
+func (nss *NetworkSetStore) recordAudit(action audit.Action, reason audit.Reason, id string, labels map[string]string, net, pod string) {
+	if nss.audit == nil {
+		return
+	}
+	nss.audit.Record(audit.Entry{
+		Action:    action,
+		Reason:    reason,
+		IP:        netIP(net),
+		Net:       net,
+		Set:       id,
+		Cluster:   nss.cluster,
+		Namespace: labels[labelNetSetNamespace],
+		Pod:       pod,
+	})
+}
+
+// markChanged records the time a set changed, unless it has changed already
+// since its last sync, and must be called with the lock held
+func (nss *NetworkSetStore) markChanged(id string) {
+	if nss.changedSince == nil {
+		nss.changedSince = make(map[string]time.Time)
+	}
+	if _, ok := nss.changedSince[id]; !ok {
+		nss.changedSince[id] = time.Now()
+	}
+}
+
+// synced updates the metrics of a set synced to calico and records an event
+// for the change applied to it, if any
+func (nss *NetworkSetStore) synced(id string, action calico.Action, labels map[string]string, nets []string) {
+	nss.mu.Lock()
+	since, changed := nss.changedSince[id]
+	delete(nss.changedSince, id)
+	delete(nss.failures, id)
+	sets := len(nss.store)
+	lastLabels, known := nss.syncedLabels[id]
+	lastNets := nss.syncedNets[id]
+	if action == calico.ActionDeleted {
+		delete(nss.syncedLabels, id)
+		delete(nss.syncedNets, id)
+	} else {
+		if nss.syncedLabels == nil {
+			nss.syncedLabels = make(map[string]map[string]string)
+		}
+		if nss.syncedNets == nil {
+			nss.syncedNets = make(map[string][]string)
+		}
+		nss.syncedLabels[id] = labels
+		nss.syncedNets[id] = nets
+	}
+	nss.mu.Unlock()
+	if changed {
+		metrics.ObserveSyncLatency(since)
+	}
+	metrics.SetNetworkSets(nss.cluster, sets)
+	if action == calico.ActionDeleted {
+		nss.auditSynced(id, lastLabels, nil, lastNets)
+		nss.feed.delete(id)
+		metrics.DeleteNetworkSetNets(id)
+		// sets that did not exist are not reported as deleted
+		if known {
+			nss.events.synced(id, action, lastLabels, 0)
+			nss.notify(id, action, lastLabels, nil, lastNets)
+		}
+		return
+	}
+	metrics.SetNetworkSetNets(id, nss.cluster, labels[labelNetSetNamespace], labels[labelNetSetName], len(nets))
+	nss.auditSynced(id, labels, nets, lastNets)
+	nss.feed.update(id, labels, nets)
+	nss.events.synced(id, action, labels, len(nets))
+	if action != calico.ActionNone {
+		nss.notify(id, action, labels, nets, lastNets)
+	}
+}
+
+// notify sends a change applied to a set to the webhooks, with the nets added
+// and removed since the last sync
+func (nss *NetworkSetStore) notify(id string, action calico.Action, labels map[string]string, nets, lastNets []string) {
+	if nss.webhooks == nil {
+		return
+	}
+	change := webhook.Change{
+		Set:     id,
+		Cluster: nss.cluster,
+		Action:  string(action),
+		Labels:  labels,
+		Nets:    append([]string{}, nets...),
+		Added:   []string{},
+		Removed: []string{},
+	}
+	for _, net := range nets {
+		if _, found := inSlice(lastNets, net); !found {
+			change.Added = append(change.Added, net)
+		}
+	}
+	for _, net := range lastNets {
+		if _, found := inSlice(nets, net); !found {
+			change.Removed = append(change.Removed, net)
+		}
+	}
+	nss.webhooks.Notify(change)
+}
+
+// syncFailed counts the consecutive failures to sync a set and records an
+// event once they reach syncFailureEventThreshold
+func (nss *NetworkSetStore) syncFailed(id string, err error) {
+	nss.mu.Lock()
+	if nss.failures == nil {
+		nss.failures = make(map[string]int)
+	}
+	nss.failures[id]++
+	failures := nss.failures[id]
+	labels := nss.syncedLabels[id]
+	if netset, ok := nss.store[id]; ok {
+		labels = netset.labels
+	}
+	nss.mu.Unlock()
+	if failures >= syncFailureEventThreshold {
+		nss.events.syncFailed(id, labels, failures, err)
+	}
 }
 
-// RunSyncLoop is the main loop to handle sync signals for network sets and
-// full store syncs.
 func (nss *NetworkSetStore) RunSyncLoop() {
 	for {
 		select {
 		case o := <-nss.syncQueue:
-			if err := nss.syncToCalico(o.id); err != nil {
-				log.Logger.Error("failed to sync netset to calico GlobalNetworkSets", "id", o.id, "error", err)
-				nss.requeue(o.id)
-			}
-		case <-nss.fullSyncQueue:
-			log.Logger.Debug("staring a new full sync loop")
-			currentNetSets, err := calico.GlobalNetworkSetList(nss.client, map[string]string{
-				labelManagedBy:     valueManagedBy,
-				labelNetSetCluster: nss.cluster,
-			})
+			nss.setBusy(true)
+			ctx, span := tracing.Start(context.Background(), "sync",
+				trace.WithLinks(trace.Link{SpanContext: o.link}),
+				trace.WithAttributes(attribute.String("set", o.id)),
+			)
+			err := nss.syncToCalico(ctx, o.id)
 			if err != nil {
-				log.Logger.Error("failed get the list of existing network sets, potential stale set left behind!", "cluster", nss.cluster, "error", err)
-			}
-			for _, n := range currentNetSets {
-				// if network set is not in the store, trigger a sync that will delete it from kube resources as well.
-				// Otherwise it will be updated bellow.
-				if _, ok := nss.store[n.Name]; !ok {
-					if err := nss.syncToCalico(n.Name); err != nil {
-						log.Logger.Error("failed to sync netset to calico GlobalNetworkSets", "id", n.Name)
-						nss.requeue(n.Name)
-					}
-				}
-			}
-			for id, _ := range nss.store {
-				if err := nss.syncToCalico(id); err != nil {
-					log.Logger.Error("failed to sync netset to calico GlobalNetworkSets", "id", id)
-					nss.requeue(id)
-				}
+				log.Store.Error("failed to sync netset to calico GlobalNetworkSets", "id", o.id, "error", err)
+				nss.syncFailed(o.id, err)
+				nss.requeue(ctx, o.id)
 			}
+			tracing.End(span, err)
+			nss.setBusy(false)
+		case <-nss.fullSyncQueue:
+			nss.setBusy(true)
+			nss.fullSync()
+			nss.setBusy(false)
 		case <-nss.stop:
-			log.Logger.Debug("Stopping network set store loop")
+			log.Store.Debug("Stopping network set store loop")
 			return
 		}
 	}
 }
 
-func (nss *NetworkSetStore) requeue(id string) {
-	log.Logger.Debug("Requeueing sync task", "id", id)
+// fullSync syncs all the sets in the store and deletes the sets of the cluster
+// that are not in the store any more.
+func (nss *NetworkSetStore) fullSync() {
+	log.Store.Debug("staring a new full sync loop")
+	start := time.Now()
+	success := true
+	ctx, span := tracing.Start(context.Background(), "full sync")
+	defer func() {
+		// the feed is missing the sets that failed to sync, which must
+		// not be taken as deleted
+		if success {
+			nss.feed.markReady()
+		}
+		metrics.ObserveFullSync(start, success)
+		span.SetAttributes(attribute.Bool("success", success))
+		span.End()
+	}()
+	currentNetSets, err := calico.GlobalNetworkSetList(ctx, nss.client, map[string]string{
+		labelManagedBy:     valueManagedBy,
+		labelNetSetCluster: nss.cluster,
+	})
+	if err != nil {
+		log.Store.Error("failed get the list of existing network sets, potential stale set left behind!", "cluster", nss.cluster, "error", err)
+		success = false
+	}
+	nss.mu.Lock()
+	if nss.syncedLabels == nil {
+		nss.syncedLabels = make(map[string]map[string]string)
+	}
+	if nss.syncedNets == nil {
+		nss.syncedNets = make(map[string][]string)
+	}
+	// the sets are synced against their state in calico, so that changes
+	// made outside of the operator are audited as they are reverted
+	for _, n := range currentNetSets {
+		nss.syncedLabels[n.Name] = n.Labels
+		nss.syncedNets[n.Name] = n.Spec.Nets
+	}
+	nss.mu.Unlock()
+	if err == nil && nss.protection != nil {
+		sizes := make(map[string]int, len(currentNetSets))
+		for _, n := range currentNetSets {
+			sizes[n.Name] = len(n.Spec.Nets)
+		}
+		nss.protection.seed(sizes)
+	}
+	ids := nss.ids()
+	for _, n := range currentNetSets {
+		// if network set is not in the store, trigger a sync that will delete it from kube resources as well.
+		// Otherwise it will be updated bellow.
+		if _, found := inSlice(ids, n.Name); !found {
+			if err := nss.syncToCalico(ctx, n.Name); err != nil {
+				log.Store.Error("failed to sync netset to calico GlobalNetworkSets", "id", n.Name)
+				nss.syncFailed(n.Name, err)
+				nss.requeue(ctx, n.Name)
+				success = false
+			}
+		}
+	}
+	for _, id := range ids {
+		if err := nss.syncToCalico(ctx, id); err != nil {
+			log.Store.Error("failed to sync netset to calico GlobalNetworkSets", "id", id)
+			nss.syncFailed(id, err)
+			nss.requeue(ctx, id)
+			success = false
+		}
+	}
+}
+
+// SyncLoopStatus describes the progress of the sync loop
+type SyncLoopStatus struct {
+	Busy         bool      `json:"busy"`
+	BusySince    time.Time `json:"busySince,omitempty"`
+	LastProgress time.Time `json:"lastProgress,omitempty"`
+}
+
+// setBusy records when the sync loop starts and finishes handling a task, so
+// that a loop blocked on a task can be detected.
+func (nss *NetworkSetStore) setBusy(busy bool) {
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+	if busy {
+		nss.busySince = time.Now()
+		return
+	}
+	nss.busySince = time.Time{}
+	nss.lastProgress = time.Now()
+}
+
+// SyncLoopStatus returns the progress of the sync loop
+func (nss *NetworkSetStore) SyncLoopStatus() SyncLoopStatus {
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+	return SyncLoopStatus{
+		Busy:         !nss.busySince.IsZero(),
+		BusySince:    nss.busySince,
+		LastProgress: nss.lastProgress,
+	}
+}
+
+// NetworkSetStatus describes a set in the store
+type NetworkSetStatus struct {
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels"`
+	Nets   []string          `json:"nets"`
+	// Pods holds the remote pod each net belongs to
+	Pods map[string]string `json:"pods"`
+	// PendingRemoval holds the nets held down and the time they will be
+	// removed at
+	PendingRemoval map[string]time.Time `json:"pendingRemoval,omitempty"`
+}
+
+// Status returns the state of all the sets in the store
+func (nss *NetworkSetStore) Status() []NetworkSetStatus {
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+	var statuses []NetworkSetStatus
+	for id, netset := range nss.store {
+		status := NetworkSetStatus{
+			ID:     id,
+			Labels: nss.resolveLabels(netset),
+			Nets:   append([]string{}, netset.nets...),
+			Pods:   make(map[string]string, len(netset.netPods)),
+		}
+		for net, pod := range netset.netPods {
+			status.Pods[net] = pod
+		}
+		for net, hd := range netset.pendingRemoval {
+			if status.PendingRemoval == nil {
+				status.PendingRemoval = make(map[string]time.Time)
+			}
+			status.PendingRemoval[net] = hd.until
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// requeue queues a sync of the set again and records the retry as an event
+// of the span in the context
+func (nss *NetworkSetStore) requeue(ctx context.Context, id string) {
+	log.Store.Debug("Requeueing sync task", "id", id)
 	metrics.IncSyncRequeue()
+	nss.mu.Lock()
+	failures := nss.failures[id]
+	nss.mu.Unlock()
+	trace.SpanFromContext(ctx).AddEvent("requeue", trace.WithAttributes(
+		attribute.String("set", id),
+		attribute.Int("failures", failures),
+	))
 	go func() {
 		time.Sleep(1)
-		nss.enqueue(id)
+		nss.enqueue(ctx, id)
 	}()
 }
 
-// write to the sync queue or yield an error after 5 seconds and retry.
-func (nss *NetworkSetStore) enqueue(id string) {
+// requeueAfter queues a sync of the set after the delay, unless one is already
+// pending
+func (nss *NetworkSetStore) requeueAfter(ctx context.Context, id string, delay time.Duration) {
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+	if _, ok := nss.delayed[id]; ok {
+		return
+	}
+	trace.SpanFromContext(ctx).AddEvent("requeue", trace.WithAttributes(
+		attribute.String("set", id),
+		attribute.String("delay", delay.String()),
+	))
+	if nss.delayed == nil {
+		nss.delayed = make(map[string]time.Time)
+	}
+	nss.delayed[id] = time.Now().Add(delay)
+	time.AfterFunc(delay, func() {
+		nss.mu.Lock()
+		delete(nss.delayed, id)
+		nss.mu.Unlock()
+		nss.enqueue(ctx, id)
+	})
+}
+
+// write to the sync queue or yield an error after 5 seconds and retry. The
+// wait for the sync loop is traced as a child of the span in the context.
+func (nss *NetworkSetStore) enqueue(ctx context.Context, id string) {
+	ctx, span := tracing.Start(ctx, "enqueue", trace.WithAttributes(attribute.String("set", id)))
+	defer span.End()
+	nss.trackQueued(id, 1)
 	select {
-	case nss.syncQueue <- SyncObject{id: id}:
-		log.Logger.Debug("Sync task queued", "id", id)
+	case nss.syncQueue <- SyncObject{id: id, link: span.SpanContext()}:
+		nss.trackQueued(id, -1)
+		log.Store.Debug("Sync task queued", "id", id)
 	case <-time.After(5 * time.Second):
-		log.Logger.Error("Timed out trying to queue a sync action for netset, run queue is full", "id", id)
+		nss.trackQueued(id, -1)
+		log.Store.Error("Timed out trying to queue a sync action for netset, run queue is full", "id", id)
 		metrics.IncSyncQueueFullFailures()
-		nss.requeue(id)
+		span.SetStatus(codes.Error, "sync queue full")
+		nss.requeue(ctx, id)
+	}
+}
+
+// queuedSync tracks the syncs of a set waiting to be picked up by the sync
+// loop
+type queuedSync struct {
+	since   time.Time
+	waiting int
+}
+
+func (nss *NetworkSetStore) trackQueued(id string, delta int) {
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+	if nss.queued == nil {
+		nss.queued = make(map[string]*queuedSync)
+	}
+	q, ok := nss.queued[id]
+	if !ok {
+		q = &queuedSync{since: time.Now()}
+		nss.queued[id] = q
+	}
+	q.waiting += delta
+	if q.waiting <= 0 {
+		delete(nss.queued, id)
 	}
 }
 
-// EnqueueSync calculates the network set store id and adds to the sync queue
-func (nss *NetworkSetStore) EnqueueNetSetSync(name, namespace string) {
+// QueuedSync describes a sync of a set waiting to run
+type QueuedSync struct {
+	ID string `json:"id"`
+	// Since is the time a pending sync has been waiting since, and Due the
+	// time a delayed sync will be queued at
+	Since time.Time `json:"since,omitempty"`
+	Due   time.Time `json:"due,omitempty"`
+	// Failures is the number of consecutive failures to sync the set, that
+	// are being retried
+	Failures int `json:"failures,omitempty"`
+}
+
+// QueueStatus describes the syncs waiting for the sync loop, and the ones
+// delayed by the deletion protection
+type QueueStatus struct {
+	Pending []QueuedSync `json:"pending"`
+	Delayed []QueuedSync `json:"delayed"`
+}
+
+// QueueStatus returns the syncs waiting to run
+func (nss *NetworkSetStore) QueueStatus() QueueStatus {
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+	status := QueueStatus{
+		Pending: []QueuedSync{},
+		Delayed: []QueuedSync{},
+	}
+	for id, q := range nss.queued {
+		status.Pending = append(status.Pending, QueuedSync{ID: id, Since: q.since, Failures: nss.failures[id]})
+	}
+	for id, due := range nss.delayed {
+		status.Delayed = append(status.Delayed, QueuedSync{ID: id, Due: due, Failures: nss.failures[id]})
+	}
+	sort.Slice(status.Pending, func(i, j int) bool { return status.Pending[i].ID < status.Pending[j].ID })
+	sort.Slice(status.Delayed, func(i, j int) bool { return status.Delayed[i].ID < status.Delayed[j].ID })
+	return status
+}
+
+// EnqueueSync adds the sets with the given store ids to the sync queue
+func (nss *NetworkSetStore) EnqueueSync(ctx context.Context, ids ...string) {
+	for _, id := range ids {
+		nss.enqueue(ctx, id)
+	}
+}
+
+// EnqueueNetSetSync calculates the network set store id and adds to the sync
+// queue
+func (nss *NetworkSetStore) EnqueueNetSetSync(ctx context.Context, name, namespace string) {
 	id := makeNetworkSetID(name, namespace, nss.cluster)
-	nss.enqueue(id)
+	nss.enqueue(ctx, id)
+}
+
+// EnqueueNamespaceNetSetSync calculates the store id of a namespace set and
+// adds it to the sync queue
+func (nss *NetworkSetStore) EnqueueNamespaceNetSetSync(ctx context.Context, namespace string) {
+	id := makeNamespaceNetworkSetID(namespace, nss.cluster)
+	nss.enqueue(ctx, id)
 }
 
 // makeNetworkSetID returns the name of the respective calico GlobalNetworkSet
@@ -186,6 +1072,15 @@ func makeNetworkSetID(name, namespace, cluster string) string {
 	return fmt.Sprintf("%s-%s-%s", cluster, namespace, name)
 }
 
+// makeNamespaceNetworkSetID returns the name of the calico GlobalNetworkSet
+// that contains all the pods of a namespace. The cluster is separated by a
+// dot, which cannot collide with the ids of makeNetworkSetID since they always
+// start with the cluster and a dash, eg namespace a-b and namespace a with app
+// b would both be c-a-b otherwise.
+func makeNamespaceNetworkSetID(namespace, cluster string) string {
+	return fmt.Sprintf("%s.%s", cluster, namespace)
+}
+
 func inSlice(slice []string, val string) (int, bool) {
 	for i, item := range slice {
 		if item == val {
@@ -195,6 +1090,18 @@ func inSlice(slice []string, val string) (int, bool) {
 	return -1, false
 }
 
+func equalLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
 func removeFromSlice(slice []string, i int) []string {
 	slice[len(slice)-1], slice[i] = slice[i], slice[len(slice)-1]
 	return slice[:len(slice)-1]
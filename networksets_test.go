@@ -1,11 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"github.com/utilitywarehouse/semaphore-policy/audit"
+	"github.com/utilitywarehouse/semaphore-policy/calico"
 	"github.com/utilitywarehouse/semaphore-policy/log"
+	"github.com/utilitywarehouse/semaphore-policy/webhook"
 )
 
 func TestNetworkSets(t *testing.T) {
@@ -17,7 +30,7 @@ func TestNetworkSets(t *testing.T) {
 	assert.Equal(t, "test", netsSetStore.cluster)
 
 	// Add a net to a set
-	netsSetStore.AddNet("name", "namespace", "10.0.0.0/24")
+	netsSetStore.AddNet("name", "namespace", "10.0.0.0/24", "pod", audit.ReasonAdd)
 	assert.Equal(t, 1, len(netsSetStore.store))
 	id := makeNetworkSetID("name", "namespace", "test")
 	expectedLables := map[string]string{
@@ -31,14 +44,14 @@ func TestNetworkSets(t *testing.T) {
 	assert.Equal(t, expectedLables, netsSetStore.store[id].labels)
 
 	// Add the same net to the set again - set should remain the same
-	netsSetStore.AddNet("name", "namespace", "10.0.0.0/24")
+	netsSetStore.AddNet("name", "namespace", "10.0.0.0/24", "pod", audit.ReasonAdd)
 	assert.Equal(t, 1, len(netsSetStore.store))
 	assert.Equal(t, 1, len(netsSetStore.store[id].nets))
 	assert.Equal(t, "10.0.0.0/24", netsSetStore.store[id].nets[0])
 	assert.Equal(t, expectedLables, netsSetStore.store[id].labels)
 
 	// Add a new net to the set again
-	netsSetStore.AddNet("name", "namespace", "10.0.0.1/24")
+	netsSetStore.AddNet("name", "namespace", "10.0.0.1/24", "pod", audit.ReasonAdd)
 	assert.Equal(t, 1, len(netsSetStore.store))
 	assert.Equal(t, 2, len(netsSetStore.store[id].nets))
 	assert.Equal(t, "10.0.0.0/24", netsSetStore.store[id].nets[0])
@@ -46,7 +59,7 @@ func TestNetworkSets(t *testing.T) {
 	assert.Equal(t, expectedLables, netsSetStore.store[id].labels)
 
 	// Add a different net for a new set
-	netsSetStore.AddNet("name2", "namespace2", "10.0.0.1/24")
+	netsSetStore.AddNet("name2", "namespace2", "10.0.0.1/24", "pod", audit.ReasonAdd)
 	assert.Equal(t, 2, len(netsSetStore.store))
 	assert.Equal(t, 2, len(netsSetStore.store[id].nets))
 	assert.Equal(t, "10.0.0.0/24", netsSetStore.store[id].nets[0])
@@ -64,7 +77,7 @@ func TestNetworkSets(t *testing.T) {
 	assert.Equal(t, expectedLables2, netsSetStore.store[id2].labels)
 
 	// Delete a net from a set
-	netsSetStore.DeleteNet("name", "namespace", "10.0.0.1/24")
+	netsSetStore.DeleteNet("name", "namespace", "10.0.0.1/24", audit.ReasonDelete)
 	assert.Equal(t, 2, len(netsSetStore.store))
 	assert.Equal(t, 1, len(netsSetStore.store[id].nets))
 	assert.Equal(t, "10.0.0.0/24", netsSetStore.store[id].nets[0])
@@ -74,16 +87,346 @@ func TestNetworkSets(t *testing.T) {
 	assert.Equal(t, expectedLables2, netsSetStore.store[id2].labels)
 
 	// Delete the last net from a set - that should delete the set itself
-	netsSetStore.DeleteNet("name2", "namespace2", "10.0.0.1/24")
+	netsSetStore.DeleteNet("name2", "namespace2", "10.0.0.1/24", audit.ReasonDelete)
 	assert.Equal(t, 1, len(netsSetStore.store))
 	assert.Equal(t, 1, len(netsSetStore.store[id].nets))
 	assert.Equal(t, "10.0.0.0/24", netsSetStore.store[id].nets[0])
 	assert.Equal(t, expectedLables, netsSetStore.store[id].labels)
 
 	// Delete non existing net - should cause no action
-	netsSetStore.DeleteNet("name", "namespace", "10.0.0.1/24")
+	netsSetStore.DeleteNet("name", "namespace", "10.0.0.1/24", audit.ReasonDelete)
 	assert.Equal(t, 1, len(netsSetStore.store))
 	assert.Equal(t, 1, len(netsSetStore.store[id].nets))
 	assert.Equal(t, "10.0.0.0/24", netsSetStore.store[id].nets[0])
 	assert.Equal(t, expectedLables, netsSetStore.store[id].labels)
 }
+
+func TestNetworkSetIDs(t *testing.T) {
+	log.InitLogger("test", "debug")
+	netsSetStore := NetworkSetStore{
+		store:   make(map[string]*NetworkSet),
+		cluster: "c",
+	}
+	// the set of namespace a-b and the set of app b in namespace a
+	assert.NotEqual(t, makeNamespaceNetworkSetID("a-b", "c"), makeNetworkSetID("b", "a", "c"))
+	netsSetStore.AddNamespaceNet("a-b", "10.0.0.1/32", "pod-1", audit.ReasonAdd)
+	netsSetStore.AddNet("b", "a", "10.0.0.2/32", "pod-2", audit.ReasonAdd)
+	assert.Equal(t, 2, len(netsSetStore.store))
+	assert.Equal(t, []string{"10.0.0.1/32"}, netsSetStore.store[makeNamespaceNetworkSetID("a-b", "c")].nets)
+	assert.Equal(t, []string{"10.0.0.2/32"}, netsSetStore.store[makeNetworkSetID("b", "a", "c")].nets)
+}
+
+func TestNetworkSetsPropagatedLabels(t *testing.T) {
+	log.InitLogger("test", "debug")
+	netsSetStore := NetworkSetStore{
+		store:   make(map[string]*NetworkSet),
+		cluster: "test",
+	}
+	id := makeNetworkSetID("name", "namespace", "test")
+	netsSetStore.AddNet("name", "namespace", "10.0.0.1/32", "pod", audit.ReasonAdd)
+	netsSetStore.AddNet("name", "namespace", "10.0.0.2/32", "pod", audit.ReasonAdd)
+
+	// Labels agreed by all nets are propagated
+	assert.True(t, netsSetStore.SetNetLabels("name", "namespace", "10.0.0.1/32", map[string]string{"team": "a"}))
+	assert.True(t, netsSetStore.SetNetLabels("name", "namespace", "10.0.0.2/32", map[string]string{"team": "a"}))
+	assert.False(t, netsSetStore.SetNetLabels("name", "namespace", "10.0.0.2/32", map[string]string{"team": "a"}))
+	labels, _, _ := netsSetStore.get(id)
+	assert.Equal(t, "a", labels["team"])
+
+	// Unknown nets are ignored
+	assert.False(t, netsSetStore.SetNetLabels("name", "namespace", "10.0.0.3/32", map[string]string{"team": "a"}))
+
+	// Conflicting values leave the label out, and are reported once
+	conflicts := labelConflictsReported(t, "team")
+	netsSetStore.SetNetLabels("name", "namespace", "10.0.0.2/32", map[string]string{"team": "b"})
+	labels, _, _ = netsSetStore.get(id)
+	_, ok := labels["team"]
+	assert.False(t, ok)
+	netsSetStore.get(id)
+	assert.Equal(t, conflicts+1, labelConflictsReported(t, "team"))
+
+	// So does a net missing the label, which does not report the ongoing
+	// conflict again
+	netsSetStore.SetNetLabels("name", "namespace", "10.0.0.2/32", map[string]string{})
+	labels, _, _ = netsSetStore.get(id)
+	_, ok = labels["team"]
+	assert.False(t, ok)
+	assert.Equal(t, conflicts+1, labelConflictsReported(t, "team"))
+
+	// Removing the odd net resolves the conflict
+	netsSetStore.DeleteNet("name", "namespace", "10.0.0.2/32", audit.ReasonDelete)
+	labels, _, _ = netsSetStore.get(id)
+	assert.Equal(t, "a", labels["team"])
+	assert.Equal(t, 0, len(netsSetStore.store[id].labelConflicts))
+
+	// and a new conflict is reported again
+	netsSetStore.AddNet("name", "namespace", "10.0.0.3/32", "pod", audit.ReasonAdd)
+	assert.Equal(t, conflicts+2, labelConflictsReported(t, "team"))
+	netsSetStore.DeleteNet("name", "namespace", "10.0.0.3/32", audit.ReasonDelete)
+
+	// Namespace labels apply to the sets of the namespace, pod labels win
+	ids := netsSetStore.SetNamespaceLabels("namespace", map[string]string{"team": "ns", "env": "prod"})
+	assert.Equal(t, []string{id}, ids)
+	assert.Nil(t, netsSetStore.SetNamespaceLabels("other", map[string]string{"env": "dev"}))
+	labels, _, _ = netsSetStore.get(id)
+	assert.Equal(t, "a", labels["team"])
+	assert.Equal(t, "prod", labels["env"])
+	// and are reported by the status as synced to calico
+	assert.Equal(t, labels, netsSetStore.Status()[0].Labels)
+
+	// Operator labels cannot be overridden
+	netsSetStore.SetNamespaceLabels("namespace", map[string]string{labelNetSetName: "other"})
+	labels, _, _ = netsSetStore.get(id)
+	assert.Equal(t, "name", labels[labelNetSetName])
+}
+
+// labelConflictsReported returns the conflicts on a propagated pod label
+// counted so far
+func labelConflictsReported(t *testing.T, label string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != "semaphore_policy_propagated_label_conflicts_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "label" && l.GetValue() == label {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestNetworkSetsRemovalHoldDown(t *testing.T) {
+	log.InitLogger("test", "debug")
+	nss := &NetworkSetStore{
+		store:           make(map[string]*NetworkSet),
+		cluster:         "test",
+		syncQueue:       make(chan SyncObject),
+		removalHoldDown: 50 * time.Millisecond,
+	}
+	id := makeNetworkSetID("name", "namespace", "test")
+	otherID := makeNetworkSetID("other", "namespace", "test")
+	nss.AddNet("name", "namespace", "10.0.0.1/32", "pod", audit.ReasonAdd)
+	nss.AddNet("name", "namespace", "10.0.0.2/32", "pod", audit.ReasonAdd)
+
+	// Removed nets are kept and reported as pending removal
+	nss.DeleteNet("name", "namespace", "10.0.0.1/32", audit.ReasonDelete)
+	_, nets, _ := nss.get(id)
+	assert.Equal(t, []string{"10.0.0.1/32", "10.0.0.2/32"}, nets)
+	status := nss.Status()
+	assert.Equal(t, 1, len(status))
+	assert.Contains(t, status[0].PendingRemoval, "10.0.0.1/32")
+
+	// and removed after the hold-down, with a sync of the set
+	o := <-nss.syncQueue
+	assert.Equal(t, id, o.id)
+	_, nets, _ = nss.get(id)
+	assert.Equal(t, []string{"10.0.0.2/32"}, nets)
+
+	// Re-adding a net to the same set cancels its removal
+	nss.DeleteNet("name", "namespace", "10.0.0.2/32", audit.ReasonDelete)
+	nss.AddNet("name", "namespace", "10.0.0.2/32", "pod", audit.ReasonAdd)
+	_, nets, _ = nss.get(id)
+	assert.Equal(t, []string{"10.0.0.2/32"}, nets)
+	assert.Nil(t, nss.Status()[0].PendingRemoval)
+
+	// A net reclaimed by a pod in another set is removed right away, and
+	// the set it was held down in is left to the caller to sync
+	nss.DeleteNet("name", "namespace", "10.0.0.2/32", audit.ReasonDelete)
+	_, reclaimedFrom := nss.AddNet("other", "namespace", "10.0.0.2/32", "pod", audit.ReasonAdd)
+	assert.Equal(t, []string{id}, reclaimedFrom)
+	_, _, ok := nss.get(id)
+	assert.False(t, ok)
+	_, nets, _ = nss.get(otherID)
+	assert.Equal(t, []string{"10.0.0.2/32"}, nets)
+
+	// No more syncs are queued by cancelled hold-downs
+	select {
+	case o := <-nss.syncQueue:
+		t.Fatalf("unexpected sync of %s", o.id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// auditBuffer collects audit entries written from timers
+type auditBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *auditBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func auditEntries(t *testing.T, b *auditBuffer) []audit.Entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var entries []audit.Entry
+	dec := json.NewDecoder(&b.buf)
+	for dec.More() {
+		var e audit.Entry
+		assert.NoError(t, dec.Decode(&e))
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestNetworkSetsAudit(t *testing.T) {
+	log.InitLogger("test", "debug")
+	var buf auditBuffer
+	fc, client := newFakeCalico(t, v3.GlobalNetworkSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-stale", Labels: map[string]string{
+			labelManagedBy:       valueManagedBy,
+			labelNetSetCluster:   "test",
+			labelNetSetNamespace: "stale",
+		}},
+		Spec: v3.GlobalNetworkSetSpec{Nets: []string{"10.0.0.9/32"}},
+	})
+	nss := newNetworkSetStore("test", client)
+	nss.audit = audit.New(&buf)
+	nss.protection = newDeletionProtection(deletionProtectionConfig{
+		enabled:          true,
+		maxSetFraction:   0.25,
+		maxTotalFraction: 1,
+		stepInterval:     time.Hour,
+	}, func() bool { return true })
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-nss.syncQueue:
+			case <-done:
+				return
+			}
+		}
+	}()
+	ctx := context.Background()
+	id := makeNetworkSetID("name", "namespace", "test")
+
+	// Changes are recorded once synced to calico, and only actual changes
+	nss.AddNet("name", "namespace", "10.0.0.1/32", "pod", audit.ReasonAdd)
+	nss.AddNet("name", "namespace", "10.0.0.1/32", "pod", audit.ReasonModify)
+	assert.Equal(t, 0, len(auditEntries(t, &buf)))
+	assert.NoError(t, nss.syncToCalico(ctx, id))
+	entries := auditEntries(t, &buf)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, audit.Entry{
+		Version:   audit.SchemaVersion,
+		Time:      entries[0].Time,
+		Action:    audit.ActionAdded,
+		Reason:    audit.ReasonAdd,
+		IP:        "10.0.0.1",
+		Net:       "10.0.0.1/32",
+		Set:       id,
+		Cluster:   "test",
+		Namespace: "namespace",
+		Pod:       "pod",
+	}, entries[0])
+	nss.AddNet("name", "namespace", "10.0.0.2/32", "pod-2", audit.ReasonAdd)
+	assert.NoError(t, nss.syncToCalico(ctx, id))
+	assert.Equal(t, 1, len(auditEntries(t, &buf)))
+
+	// The full sync removes stale sets and reverts changes made outside
+	// of the operator
+	gns, _ := fc.get(id)
+	gns.Spec.Nets = []string{"10.0.0.1/32", "10.0.0.3/32"}
+	fc.mu.Lock()
+	fc.sets[id] = gns
+	fc.mu.Unlock()
+	nss.fullSync()
+	entries = auditEntries(t, &buf)
+	if assert.Equal(t, 3, len(entries)) {
+		assert.Equal(t, [4]string{"removed", "gc", "10.0.0.9/32", ""}, auditSummary(entries[0]))
+		assert.Equal(t, "stale", entries[0].Namespace)
+		assert.Equal(t, [4]string{"added", "drift-revert", "10.0.0.2/32", "pod-2"}, auditSummary(entries[1]))
+		assert.Equal(t, [4]string{"removed", "drift-revert", "10.0.0.3/32", ""}, auditSummary(entries[2]))
+	}
+
+	// Removals held back by the deletion protection are recorded once
+	// they reach calico
+	nss.DeleteNet("name", "namespace", "10.0.0.1/32", audit.ReasonDelete)
+	assert.NoError(t, nss.syncToCalico(ctx, id))
+	assert.Equal(t, 0, len(auditEntries(t, &buf)))
+	gns, _ = fc.get(id)
+	gns.Annotations = map[string]string{annotationConfirmDeletions: "true"}
+	fc.mu.Lock()
+	fc.sets[id] = gns
+	fc.mu.Unlock()
+	assert.NoError(t, nss.syncToCalico(ctx, id))
+	entries = auditEntries(t, &buf)
+	if assert.Equal(t, 1, len(entries)) {
+		assert.Equal(t, [4]string{"removed", "delete", "10.0.0.1/32", "pod"}, auditSummary(entries[0]))
+	}
+
+	// A net held down and taken over by another pod is removed with its
+	// own reason
+	nss.protection = nil
+	nss.removalHoldDown = time.Hour
+	nss.DeleteNet("name", "namespace", "10.0.0.2/32", audit.ReasonModify)
+	nss.AddNet("other", "namespace", "10.0.0.2/32", "pod-3", audit.ReasonAdd)
+	assert.NoError(t, nss.syncToCalico(ctx, id))
+	assert.NoError(t, nss.syncToCalico(ctx, makeNetworkSetID("other", "namespace", "test")))
+	entries = auditEntries(t, &buf)
+	if assert.Equal(t, 2, len(entries)) {
+		assert.Equal(t, [4]string{"removed", "takeover", "10.0.0.2/32", "pod-2"}, auditSummary(entries[0]))
+		assert.Equal(t, [4]string{"added", "add", "10.0.0.2/32", "pod-3"}, auditSummary(entries[1]))
+	}
+	assert.Equal(t, 0, len(nss.auditCauses))
+}
+
+func auditSummary(e audit.Entry) [4]string {
+	return [4]string{string(e.Action), string(e.Reason), e.Net, e.Pod}
+}
+
+func TestNetworkSetsWebhooks(t *testing.T) {
+	log.InitLogger("test", "debug")
+	received := make(chan webhook.Change, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var c webhook.Change
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&c))
+		received <- c
+	}))
+	defer srv.Close()
+	hooks, err := webhook.New([]webhook.Config{{Name: "test", URL: srv.URL, Secret: []byte("secret")}})
+	assert.NoError(t, err)
+	hooks.Start()
+	defer hooks.Stop()
+	nss := &NetworkSetStore{
+		store:    make(map[string]*NetworkSet),
+		cluster:  "test",
+		webhooks: hooks,
+	}
+	id := makeNetworkSetID("name", "namespace", "test")
+	labels := map[string]string{labelNetSetNamespace: "namespace"}
+
+	nss.synced(id, calico.ActionCreated, labels, []string{"10.0.0.1/32", "10.0.0.2/32"})
+	c := <-received
+	assert.Equal(t, "Created", c.Action)
+	assert.Equal(t, []string{"10.0.0.1/32", "10.0.0.2/32"}, c.Added)
+	assert.Equal(t, []string{}, c.Removed)
+
+	// Unchanged sets are not notified, and deltas are against the last
+	// sync
+	nss.synced(id, calico.ActionNone, labels, []string{"10.0.0.1/32", "10.0.0.2/32"})
+	nss.synced(id, calico.ActionUpdated, labels, []string{"10.0.0.2/32", "10.0.0.3/32"})
+	c = <-received
+	assert.Equal(t, "Updated", c.Action)
+	assert.Equal(t, []string{"10.0.0.2/32", "10.0.0.3/32"}, c.Nets)
+	assert.Equal(t, []string{"10.0.0.3/32"}, c.Added)
+	assert.Equal(t, []string{"10.0.0.1/32"}, c.Removed)
+
+	// Deleted sets report their last labels and nets as removed
+	nss.synced(id, calico.ActionDeleted, nil, nil)
+	c = <-received
+	assert.Equal(t, "Deleted", c.Action)
+	assert.Equal(t, labels, c.Labels)
+	assert.Equal(t, []string{"10.0.0.2/32", "10.0.0.3/32"}, c.Removed)
+	assert.Equal(t, 0, len(received))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/utilitywarehouse/semaphore-policy/metrics"
+)
+
+// annotationConfirmDeletions on a GlobalNetworkSet confirms that removals
+// above the protection thresholds can be applied at once. It is cleared once
+// the removals are applied.
+const annotationConfirmDeletions = "policy.semaphore.uw.io/confirm-deletions"
+
+type deletionProtectionConfig struct {
+	enabled bool
+	// fraction of the nets of a set, and of all the sets, that can be
+	// removed at once without confirmation
+	maxSetFraction   float64
+	maxTotalFraction float64
+	// minimum interval between the steps of a gradual removal
+	stepInterval time.Duration
+}
+
+func (c deletionProtectionConfig) validate() error {
+	if !c.enabled {
+		return nil
+	}
+	if c.maxSetFraction <= 0 || c.maxSetFraction > 1 {
+		return fmt.Errorf("max set fraction must be in (0, 1], got %v", c.maxSetFraction)
+	}
+	if c.maxTotalFraction <= 0 || c.maxTotalFraction > 1 {
+		return fmt.Errorf("max total fraction must be in (0, 1], got %v", c.maxTotalFraction)
+	}
+	if c.stepInterval <= 0 {
+		return fmt.Errorf("step interval must be positive, got %v", c.stepInterval)
+	}
+	return nil
+}
+
+// deletionProtection holds back the removal of nets from the sets while the
+// remote cluster is unhealthy. After a recovery, a relist or a partial list
+// can make a lot of pods look gone at once, so removals above the configured
+// fractions are applied gradually, unless confirmed.
+type deletionProtection struct {
+	deletionProtectionConfig
+	healthy func() bool
+
+	mu sync.Mutex
+	// sizes holds the number of nets of each set in calico, pending the
+	// number of removals held back and lastStep the time of the last step
+	// of a gradual removal
+	sizes    map[string]int
+	pending  map[string]int
+	lastStep map[string]time.Time
+}
+
+func newDeletionProtection(conf deletionProtectionConfig, healthy func() bool) *deletionProtection {
+	return &deletionProtection{
+		deletionProtectionConfig: conf,
+		healthy:                  healthy,
+		sizes:                    make(map[string]int),
+		pending:                  make(map[string]int),
+		lastStep:                 make(map[string]time.Time),
+	}
+}
+
+// plan returns the nets to apply to a set, given the nets currently in calico
+// and the desired ones, and the number of removals held back for later.
+func (dp *deletionProtection) plan(id string, current, desired []string, confirmed bool) ([]string, int) {
+	var removals []string
+	for _, n := range current {
+		if _, found := inSlice(desired, n); !found {
+			removals = append(removals, n)
+		}
+	}
+	sort.Strings(removals)
+
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	defer dp.updateMetrics()
+	dp.sizes[id] = len(current)
+	if len(removals) == 0 {
+		delete(dp.pending, id)
+		return desired, 0
+	}
+	if !dp.healthy() {
+		dp.pending[id] = len(removals)
+		return mergeNets(desired, removals), len(removals)
+	}
+	if confirmed || !dp.exceedsThresholds(id, len(removals)) {
+		delete(dp.pending, id)
+		return desired, 0
+	}
+	if time.Since(dp.lastStep[id]) < dp.stepInterval {
+		dp.pending[id] = len(removals)
+		return mergeNets(desired, removals), len(removals)
+	}
+	step := int(dp.maxSetFraction * float64(len(current)))
+	if totalStep := int(dp.maxTotalFraction * float64(dp.total())); totalStep < step {
+		step = totalStep
+	}
+	if step < 1 {
+		step = 1
+	}
+	// the total fraction alone can trip the thresholds, allowing a step
+	// larger than the removals of the set
+	if step > len(removals) {
+		step = len(removals)
+	}
+	held := removals[step:]
+	dp.lastStep[id] = time.Now()
+	dp.pending[id] = len(held)
+	metrics.IncThrottledDeletions(step)
+	return mergeNets(desired, held), len(held)
+}
+
+// exceedsThresholds must be called with the lock held
+func (dp *deletionProtection) exceedsThresholds(id string, removals int) bool {
+	if float64(removals) > dp.maxSetFraction*float64(dp.sizes[id]) {
+		return true
+	}
+	totalRemovals := removals
+	for i, p := range dp.pending {
+		if i != id {
+			totalRemovals += p
+		}
+	}
+	return float64(totalRemovals) > dp.maxTotalFraction*float64(dp.total())
+}
+
+// total returns the number of nets of all the sets and must be called with the
+// lock held
+func (dp *deletionProtection) total() int {
+	total := 0
+	for _, size := range dp.sizes {
+		total += size
+	}
+	return total
+}
+
+// seed records the number of nets of all the sets in calico, so that the
+// total fraction is checked against all of them rather than the sets planned
+// so far
+func (dp *deletionProtection) seed(sizes map[string]int) {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	for id, size := range sizes {
+		dp.sizes[id] = size
+	}
+}
+
+// forget drops the state of a set that no longer exists in calico
+func (dp *deletionProtection) forget(id string) {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	delete(dp.sizes, id)
+	delete(dp.pending, id)
+	delete(dp.lastStep, id)
+	dp.updateMetrics()
+}
+
+// held returns the number of removals held back per set
+func (dp *deletionProtection) held() map[string]int {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	held := make(map[string]int, len(dp.pending))
+	for id, p := range dp.pending {
+		held[id] = p
+	}
+	return held
+}
+
+// updateMetrics must be called with the lock held
+func (dp *deletionProtection) updateMetrics() {
+	total := 0
+	for _, p := range dp.pending {
+		total += p
+	}
+	metrics.SetHeldDeletions(total, len(dp.pending))
+}
+
+func mergeNets(a, b []string) []string {
+	nets := make([]string, 0, len(a)+len(b))
+	nets = append(nets, a...)
+	for _, n := range b {
+		if _, found := inSlice(nets, n); !found {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	calicoClientset "github.com/projectcalico/api/pkg/client/clientset_generated/clientset"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/utilitywarehouse/semaphore-policy/audit"
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+// fakeCalico serves the GlobalNetworkSets api of calico from memory
+type fakeCalico struct {
+	mu   sync.Mutex
+	sets map[string]v3.GlobalNetworkSet
+	// failing fails all the requests
+	failing bool
+}
+
+const globalNetworkSetsPath = "/apis/projectcalico.org/v3/globalnetworksets"
+
+func newFakeCalico(t *testing.T, sets ...v3.GlobalNetworkSet) (*fakeCalico, *calicoClientset.Clientset) {
+	fc := &fakeCalico{sets: make(map[string]v3.GlobalNetworkSet)}
+	for _, s := range sets {
+		fc.sets[s.Name] = s
+	}
+	server := httptest.NewServer(fc)
+	t.Cleanup(server.Close)
+	client, err := calicoClientset.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fc, client
+}
+
+func (fc *fakeCalico) setFailing(failing bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.failing = failing
+}
+
+func (fc *fakeCalico) get(name string) (v3.GlobalNetworkSet, bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	s, ok := fc.sets[name]
+	return s, ok
+}
+
+func (fc *fakeCalico) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, globalNetworkSetsPath), "/")
+	reply := func(code int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(v)
+	}
+	notFound := func() {
+		reply(http.StatusNotFound, metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusFailure,
+			Reason:   metav1.StatusReasonNotFound,
+			Code:     http.StatusNotFound,
+		})
+	}
+	if fc.failing {
+		reply(http.StatusInternalServerError, metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusFailure,
+			Reason:   metav1.StatusReasonInternalError,
+			Code:     http.StatusInternalServerError,
+		})
+		return
+	}
+	var gns v3.GlobalNetworkSet
+	switch r.Method {
+	case http.MethodGet:
+		if name == "" {
+			list := v3.GlobalNetworkSetList{}
+			for _, s := range fc.sets {
+				list.Items = append(list.Items, s)
+			}
+			reply(http.StatusOK, list)
+			return
+		}
+		s, ok := fc.sets[name]
+		if !ok {
+			notFound()
+			return
+		}
+		reply(http.StatusOK, s)
+	case http.MethodPost, http.MethodPut:
+		json.NewDecoder(r.Body).Decode(&gns)
+		fc.sets[gns.Name] = gns
+		reply(http.StatusOK, gns)
+	case http.MethodDelete:
+		if _, ok := fc.sets[name]; !ok {
+			notFound()
+			return
+		}
+		delete(fc.sets, name)
+		reply(http.StatusOK, metav1.Status{Status: metav1.StatusSuccess})
+	}
+}
+
+func TestDeletionProtectionHoldsWhileUnhealthy(t *testing.T) {
+	healthy := false
+	dp := newDeletionProtection(deletionProtectionConfig{
+		enabled:          true,
+		maxSetFraction:   0.5,
+		maxTotalFraction: 1,
+		stepInterval:     time.Hour,
+	}, func() bool { return healthy })
+
+	current := []string{"10.0.0.1/32", "10.0.0.2/32"}
+	nets, held := dp.plan("set", current, []string{"10.0.0.1/32", "10.0.0.3/32"}, false)
+	assert.Equal(t, 1, held)
+	assert.ElementsMatch(t, []string{"10.0.0.1/32", "10.0.0.2/32", "10.0.0.3/32"}, nets)
+	assert.Equal(t, map[string]int{"set": 1}, dp.held())
+
+	// Once healthy, removals within the thresholds are applied
+	healthy = true
+	nets, held = dp.plan("set", current, []string{"10.0.0.1/32", "10.0.0.3/32"}, false)
+	assert.Equal(t, 0, held)
+	assert.Equal(t, []string{"10.0.0.1/32", "10.0.0.3/32"}, nets)
+	assert.Equal(t, map[string]int{}, dp.held())
+}
+
+func TestDeletionProtectionGradualRemoval(t *testing.T) {
+	dp := newDeletionProtection(deletionProtectionConfig{
+		enabled:          true,
+		maxSetFraction:   0.5,
+		maxTotalFraction: 1,
+		stepInterval:     time.Hour,
+	}, func() bool { return true })
+
+	current := []string{"10.0.0.1/32", "10.0.0.2/32", "10.0.0.3/32", "10.0.0.4/32"}
+	// Removing all the nets removes half of them in the first step
+	nets, held := dp.plan("set", current, nil, false)
+	assert.Equal(t, 2, held)
+	assert.Equal(t, []string{"10.0.0.3/32", "10.0.0.4/32"}, nets)
+
+	// and holds the rest until the next step is due
+	nets, held = dp.plan("set", nets, nil, false)
+	assert.Equal(t, 2, held)
+	assert.Equal(t, []string{"10.0.0.3/32", "10.0.0.4/32"}, nets)
+
+	// unless confirmed
+	nets, held = dp.plan("set", nets, nil, true)
+	assert.Equal(t, 0, held)
+	assert.Equal(t, 0, len(nets))
+
+	dp.forget("set")
+	assert.Equal(t, map[string]int{}, dp.held())
+}
+
+func TestDeletionProtectionTotalFraction(t *testing.T) {
+	dp := newDeletionProtection(deletionProtectionConfig{
+		enabled:          true,
+		maxSetFraction:   1,
+		maxTotalFraction: 0.2,
+		stepInterval:     time.Hour,
+	}, func() bool { return true })
+
+	big := []string{"10.0.0.1/32", "10.0.0.2/32", "10.0.0.3/32", "10.0.0.4/32", "10.0.0.5/32", "10.0.0.6/32", "10.0.0.7/32", "10.0.0.8/32"}
+	_, held := dp.plan("big", big, big, false)
+	assert.Equal(t, 0, held)
+	// Removing a whole set of 2 nets out of 10 is within the threshold
+	small := []string{"10.0.1.1/32", "10.0.1.2/32"}
+	nets, held := dp.plan("small", small, nil, false)
+	assert.Equal(t, 0, held)
+	assert.Equal(t, 0, len(nets))
+
+	// Removing 3 out of 10 is not, and is applied in steps of 2
+	nets, held = dp.plan("big", big, big[3:], false)
+	assert.Equal(t, 1, held)
+	assert.Equal(t, 6, len(nets))
+	assert.Contains(t, nets, "10.0.0.3/32")
+}
+
+func TestDeletionProtectionTotalFractionOnly(t *testing.T) {
+	dp := newDeletionProtection(deletionProtectionConfig{
+		enabled:          true,
+		maxSetFraction:   1,
+		maxTotalFraction: 0.5,
+		stepInterval:     time.Hour,
+	}, func() bool { return true })
+	dp.seed(map[string]int{"other": 10, "set": 10})
+	dp.pending["other"] = 8
+
+	// 3 removals are within the set fraction, but trip the total fraction
+	// along with the ones held for the other set, and are applied at once
+	// as the step allowed is larger than them
+	current := []string{"10.0.0.1/32", "10.0.0.2/32", "10.0.0.3/32", "10.0.0.4/32", "10.0.0.5/32", "10.0.0.6/32", "10.0.0.7/32", "10.0.0.8/32", "10.0.0.9/32", "10.0.0.10/32"}
+	nets, held := dp.plan("set", current, current[3:], false)
+	assert.Equal(t, 0, held)
+	assert.Equal(t, current[3:], nets)
+}
+
+func TestDeletionProtectionSeed(t *testing.T) {
+	dp := newDeletionProtection(deletionProtectionConfig{
+		enabled:          true,
+		maxSetFraction:   1,
+		maxTotalFraction: 0.2,
+		stepInterval:     time.Hour,
+	}, func() bool { return true })
+	// Without the sizes of the other sets, removing a whole set would be
+	// checked against its own size only
+	dp.seed(map[string]int{"small": 2, "big": 8})
+	nets, held := dp.plan("small", []string{"10.0.1.1/32", "10.0.1.2/32"}, nil, false)
+	assert.Equal(t, 0, held)
+	assert.Equal(t, 0, len(nets))
+}
+
+func TestProtectedSyncToCalico(t *testing.T) {
+	log.InitLogger("test", "debug")
+	current := []string{"10.0.0.1/32", "10.0.0.2/32", "10.0.0.3/32", "10.0.0.4/32"}
+	fc, client := newFakeCalico(t, v3.GlobalNetworkSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-namespace-name"},
+		Spec:       v3.GlobalNetworkSetSpec{Nets: current},
+	})
+	nss := newNetworkSetStore("test", client)
+	nss.protection = newDeletionProtection(deletionProtectionConfig{
+		enabled:          true,
+		maxSetFraction:   0.5,
+		maxTotalFraction: 1,
+		stepInterval:     time.Hour,
+	}, func() bool { return true })
+	ctx := context.Background()
+
+	// Removing 3 of 4 nets removes 2 of them, holding back the last one
+	nss.AddNet("name", "namespace", "10.0.0.1/32", "pod-1", audit.ReasonAdd)
+	assert.NoError(t, nss.syncToCalico(ctx, "test-namespace-name"))
+	gns, _ := fc.get("test-namespace-name")
+	assert.Equal(t, []string{"10.0.0.1/32", "10.0.0.4/32"}, gns.Spec.Nets)
+	assert.Equal(t, map[string]int{"test-namespace-name": 1}, nss.protection.held())
+	delayed := nss.QueueStatus().Delayed
+	if assert.Equal(t, 1, len(delayed)) {
+		assert.Equal(t, "test-namespace-name", delayed[0].ID)
+	}
+
+	// Confirmed removals are applied at once and the confirmation cleared
+	gns.Annotations = map[string]string{annotationConfirmDeletions: "true"}
+	fc.mu.Lock()
+	fc.sets[gns.Name] = gns
+	fc.mu.Unlock()
+	assert.NoError(t, nss.syncToCalico(ctx, "test-namespace-name"))
+	gns, _ = fc.get("test-namespace-name")
+	assert.Equal(t, []string{"10.0.0.1/32"}, gns.Spec.Nets)
+	assert.Empty(t, gns.Annotations[annotationConfirmDeletions])
+	assert.Equal(t, map[string]int{}, nss.protection.held())
+
+	// Sets missing from calico are created
+	nss.AddNet("other", "namespace", "10.0.0.5/32", "pod-5", audit.ReasonAdd)
+	assert.NoError(t, nss.syncToCalico(ctx, "test-namespace-other"))
+	gns, ok := fc.get("test-namespace-other")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"10.0.0.5/32"}, gns.Spec.Nets)
+
+	// and sets missing from the store are deleted once all their nets
+	// have been removed
+	nss.DeleteNet("name", "namespace", "10.0.0.1/32", audit.ReasonDelete)
+	assert.NoError(t, nss.syncToCalico(ctx, "test-namespace-name"))
+	gns, ok = fc.get("test-namespace-name")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"10.0.0.1/32"}, gns.Spec.Nets)
+	gns.Annotations = map[string]string{annotationConfirmDeletions: "true"}
+	fc.mu.Lock()
+	fc.sets[gns.Name] = gns
+	fc.mu.Unlock()
+	assert.NoError(t, nss.syncToCalico(ctx, "test-namespace-name"))
+	_, ok = fc.get("test-namespace-name")
+	assert.False(t, ok)
+	assert.NoError(t, nss.syncToCalico(ctx, "test-namespace-name"))
+}
+
+func TestDeletionProtectionConfigValidation(t *testing.T) {
+	assert.NoError(t, deletionProtectionConfig{}.validate())
+	assert.Error(t, deletionProtectionConfig{enabled: true, maxSetFraction: 0, maxTotalFraction: 0.5, stepInterval: time.Minute}.validate())
+	assert.Error(t, deletionProtectionConfig{enabled: true, maxSetFraction: 0.5, maxTotalFraction: 2, stepInterval: time.Minute}.validate())
+	assert.NoError(t, deletionProtectionConfig{enabled: true, maxSetFraction: 0.5, maxTotalFraction: 0.5, stepInterval: time.Minute}.validate())
+}
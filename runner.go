@@ -1,79 +1,352 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	calicoClientset "github.com/projectcalico/api/pkg/client/clientset_generated/clientset"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 
+	"github.com/utilitywarehouse/semaphore-policy/audit"
 	"github.com/utilitywarehouse/semaphore-policy/kube"
 	"github.com/utilitywarehouse/semaphore-policy/log"
+	"github.com/utilitywarehouse/semaphore-policy/metrics"
+	"github.com/utilitywarehouse/semaphore-policy/tracing"
 )
 
 type Runner struct {
-	podWatcher *kube.PodWatcher
-	nsStore    NetworkSetStore
-	canSync    bool
-	stop       chan struct{}
+	// one pod watcher per watched namespace, or a single one for all
+	// namespaces
+	podWatchers      []*kube.PodWatcher
+	watchNamespaces  []string
+	namespaceWatcher *kube.NamespaceWatcher
+	nsStore          *NetworkSetStore
+	canSync          atomic.Bool
+	stop             chan struct{}
+	// pod watchers for namespaces exported as a whole, keyed by namespace
+	namespacePodWatchers   map[string]*kube.PodWatcher
+	namespacePodWatchersMu sync.Mutex
+	// namespacePodWatchersWG tracks the running namespace pod watchers
+	namespacePodWatchersWG sync.WaitGroup
+	watchClient            kubernetes.Interface
+	podResyncPeriod        time.Duration
+	// remote labels to copy onto the sets
+	propagatePodLabels       []string
+	propagateNamespaceLabels []string
+	namespaceLabelsWatcher   *kube.NamespaceWatcher
+	namespaceFilter          namespaceFilter
+	cacheSync                cacheSyncConfig
+	startup                  startupState
+	// fullSyncPeriod is the interval of the full syncs after the initial
+	// one, zero disables them
+	fullSyncPeriod time.Duration
 }
 
-func newRunner(client *calicoClientset.Clientset, watchClient kubernetes.Interface, cluster string, podResyncPeriod time.Duration) *Runner {
+const (
+	// cacheSyncPolicyFail stops the operator when the initial cache sync
+	// times out
+	cacheSyncPolicyFail = "fail"
+	// cacheSyncPolicyRetry leaves the existing network sets untouched and
+	// keeps waiting for the caches when the initial sync times out
+	cacheSyncPolicyRetry = "retry"
+)
+
+// cacheSyncConfig bounds the time to wait for the watcher caches to sync on
+// startup. A zero timeout waits forever.
+type cacheSyncConfig struct {
+	timeout time.Duration
+	policy  string
+}
+
+func (c cacheSyncConfig) validate() error {
+	if c.timeout < 0 {
+		return fmt.Errorf("cache sync timeout cannot be negative")
+	}
+	if c.policy != cacheSyncPolicyFail && c.policy != cacheSyncPolicyRetry {
+		return fmt.Errorf("unknown cache sync policy %q, must be one of %s, %s", c.policy, cacheSyncPolicyFail, cacheSyncPolicyRetry)
+	}
+	return nil
+}
+
+// startupState tracks the wait for the initial cache sync
+type startupState struct {
+	mu       sync.Mutex
+	cache    string
+	since    time.Time
+	timeouts int
+}
+
+// StartupStatus is the state of the initial cache sync
+type StartupStatus struct {
+	WaitingFor   string    `json:"waitingFor,omitempty"`
+	WaitingSince time.Time `json:"waitingSince,omitempty"`
+	Timeouts     int       `json:"timeouts"`
+}
+
+func (ss *startupState) waiting(cache string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.cache = cache
+	ss.since = time.Now()
+	metrics.SetCacheSyncWaiting(cache, true)
+}
+
+func (ss *startupState) synced(cache string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.cache = ""
+	ss.since = time.Time{}
+	metrics.SetCacheSyncWaiting(cache, false)
+}
+
+func (ss *startupState) timedOut(cache string) int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.timeouts++
+	metrics.IncCacheSyncTimeouts(cache)
+	return ss.timeouts
+}
+
+func (ss *startupState) status() StartupStatus {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return StartupStatus{
+		WaitingFor:   ss.cache,
+		WaitingSince: ss.since,
+		Timeouts:     ss.timeouts,
+	}
+}
+
+// namespaceFilter decides which remote namespaces can be exported. An empty
+// allow list allows all namespaces, and the deny list takes precedence.
+type namespaceFilter struct {
+	allow []string
+	deny  []string
+}
+
+func (nf namespaceFilter) allowed(namespace string) bool {
+	if _, found := inSlice(nf.deny, namespace); found {
+		return false
+	}
+	if len(nf.allow) == 0 {
+		return true
+	}
+	_, found := inSlice(nf.allow, namespace)
+	return found
+}
+
+func newRunner(client *calicoClientset.Clientset, watchClient kubernetes.Interface, cluster string, podResyncPeriod time.Duration, namespaceSets bool, propagatePodLabels, propagateNamespaceLabels []string, nsFilter namespaceFilter, watchNamespaces []string, cacheSync cacheSyncConfig, protection deletionProtectionConfig, removalHoldDown time.Duration, ipHistorySize int) *Runner {
 	runner := &Runner{
-		nsStore: newNetworkSetStore(cluster, client),
-		canSync: false,
-		stop:    make(chan struct{}),
+		nsStore:                  newNetworkSetStore(cluster, client),
+		stop:                     make(chan struct{}),
+		namespacePodWatchers:     make(map[string]*kube.PodWatcher),
+		watchClient:              watchClient,
+		podResyncPeriod:          podResyncPeriod,
+		propagatePodLabels:       propagatableLabelKeys(propagatePodLabels),
+		propagateNamespaceLabels: propagatableLabelKeys(propagateNamespaceLabels),
+		namespaceFilter:          nsFilter,
+		watchNamespaces:          watchNamespaces,
+		cacheSync:                cacheSync,
+	}
+	runner.nsStore.removalHoldDown = removalHoldDown
+	runner.nsStore.ipIndex = newIPIndex(cluster, ipHistorySize)
+	if protection.enabled {
+		runner.nsStore.protection = newDeletionProtection(protection, runner.targetHealthy)
 	}
 
-	podWatcher := kube.NewPodWatcher(
-		watchClient,
-		podResyncPeriod,
-		runner.PodEventHandler,
-		labelNetSetName,
-	)
-	runner.podWatcher = podWatcher
-	runner.podWatcher.Init()
+	// Events from all the namespace watchers are handled by the same
+	// handler, as if they were coming from a single watch.
+	namespaces := watchNamespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	for _, namespace := range namespaces {
+		podWatcher := kube.NewPodWatcher(
+			watchClient,
+			podResyncPeriod,
+			runner.PodEventHandler,
+			runner.podAllowed,
+			kube.PodProjection(labelPrefix),
+			labelNetSetName,
+			namespace,
+		)
+		podWatcher.Init()
+		runner.podWatchers = append(runner.podWatchers, podWatcher)
+	}
+
+	if namespaceSets {
+		runner.namespaceWatcher = kube.NewNamespaceWatcher(
+			watchClient,
+			podResyncPeriod,
+			runner.NamespaceEventHandler,
+			fmt.Sprintf("%s=true", labelNamespaceExport),
+		)
+		runner.namespaceWatcher.Init()
+	}
+
+	if len(runner.propagateNamespaceLabels) > 0 {
+		runner.namespaceLabelsWatcher = kube.NewNamespaceWatcher(
+			watchClient,
+			podResyncPeriod,
+			runner.NamespaceLabelsEventHandler,
+			"",
+		)
+		runner.namespaceLabelsWatcher.Init()
+	}
 
 	return runner
 }
 
+// Start runs the watchers and waits for their caches to sync before the first
+// full sync, which deletes the sets that are not found in the caches. Until
+// then the existing network sets are left untouched.
 func (r *Runner) Start() error {
-	go r.podWatcher.Run()
+	for _, pw := range r.podWatchers {
+		go pw.Run()
+	}
 	go r.nsStore.RunSyncLoop()
-	// wait for node watcher to sync. TODO: atm dummy and could run forever
-	// if node cache fails to sync
-	stopCh := make(chan struct{})
-	if ok := cache.WaitForNamedCacheSync("podWatcher", stopCh, r.podWatcher.HasSynced); !ok {
-		return fmt.Errorf("failed to wait for pods cache to sync")
+	if ok, err := r.waitForCacheSync("podWatcher", r.podWatchersSynced); !ok {
+		return err
+	}
+	if r.namespaceWatcher != nil {
+		go r.namespaceWatcher.Run()
+		if ok, err := r.waitForCacheSync("namespaceWatcher", r.namespaceWatcher.HasSynced); !ok {
+			return err
+		}
+		// pods of the exported namespaces need to be in the store before
+		// the full sync, otherwise their sets will be deleted and recreated
+		if ok, err := r.waitForCacheSync("namespacePodWatchers", r.namespacePodWatchersSynced); !ok {
+			return err
+		}
 	}
-	r.canSync = true
+	if r.namespaceLabelsWatcher != nil {
+		go r.namespaceLabelsWatcher.Run()
+		if ok, err := r.waitForCacheSync("namespaceLabelsWatcher", r.namespaceLabelsWatcher.HasSynced); !ok {
+			return err
+		}
+	}
+	r.canSync.Store(true)
 	r.nsStore.fullSyncQueue <- struct{}{}
+	if r.fullSyncPeriod > 0 {
+		go r.runFullSyncs()
+	}
 	return nil
 }
 
-func (r *Runner) Healthy() bool {
-	return r.podWatcher.Healthy()
+// runFullSyncs queues a full sync every fullSyncPeriod, to revert the changes
+// made to the sets outside of the operator and retry failed syncs, until the
+// runner is stopped
+func (r *Runner) runFullSyncs() {
+	ticker := time.NewTicker(r.fullSyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			select {
+			case r.nsStore.fullSyncQueue <- struct{}{}:
+			case <-r.stop:
+				return
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// waitForCacheSync waits for a cache to sync, retrying after each timeout or
+// failing, depending on the cache sync policy. It returns false with a nil
+// error if the runner is stopped while waiting.
+func (r *Runner) waitForCacheSync(name string, synced cache.InformerSynced) (bool, error) {
+	r.startup.waiting(name)
+	for {
+		stopCh, cancel := r.cacheSyncStopCh()
+		ok := cache.WaitForNamedCacheSync(name, stopCh, synced)
+		cancel()
+		if ok {
+			r.startup.synced(name)
+			return true, nil
+		}
+		select {
+		case <-r.stop:
+			return false, nil
+		default:
+		}
+		timeouts := r.startup.timedOut(name)
+		if r.cacheSync.policy == cacheSyncPolicyFail {
+			return false, fmt.Errorf("timed out after %v waiting for %s cache to sync", r.cacheSync.timeout, name)
+		}
+		log.Logger.Warn("timed out waiting for cache to sync, keeping existing network sets and retrying", "cache", name, "timeout", r.cacheSync.timeout, "timeouts", timeouts)
+	}
+}
+
+// cacheSyncStopCh returns a channel that is closed when the runner is stopped
+// or the cache sync timeout expires, and a func to release its resources.
+func (r *Runner) cacheSyncStopCh() (<-chan struct{}, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if r.cacheSync.timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), r.cacheSync.timeout)
+	}
+	go func() {
+		select {
+		case <-r.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx.Done(), cancel
+}
+
+// targetHealthy is false while any of the watchers fails to list or watch
+// the remote cluster
+func (r *Runner) targetHealthy() bool {
+	for _, w := range r.watcherStatuses() {
+		if !w.ListHealthy || !w.WatchHealthy {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Runner) podWatchersSynced() bool {
+	for _, pw := range r.podWatchers {
+		if !pw.HasSynced() {
+			return false
+		}
+	}
+	return true
 }
 
 func (r *Runner) Stop() {
+	r.stopNamespacePodWatchers()
+	close(r.stop)
 	r.nsStore.stop <- struct{}{}
 }
 
 func (r *Runner) PodEventHandler(eventType watch.EventType, old *v1.Pod, new *v1.Pod) {
+	ctx, span := startPodEventSpan("pod event", eventType, old, new)
+	defer span.End()
 	switch eventType {
 	case watch.Added:
 		log.Logger.Debug("Received add event", "pod", new.Name, "ip", new.Status.PodIP)
-		r.onPodAdd(new)
+		r.onPodAdd(ctx, new)
 	case watch.Modified:
 		log.Logger.Debug("Received modify event", "new_pod", new.Name, "new_pod_ip", new.Status.PodIP, "old_pod", old.Name, "old_pod_ip", old.Status.PodIP)
-		r.onPodModify(old, new)
+		r.onPodModify(ctx, old, new)
 	case watch.Deleted:
 		log.Logger.Debug("Received delete event", "old_pod", old.Name, "old_pod_ip", old.Status.PodIP)
-		r.onPodDelete(old)
+		r.onPodDelete(ctx, old)
 	default:
 		log.Logger.Info(
 			"Unknown endpoints event received: %v",
@@ -82,56 +355,370 @@ func (r *Runner) PodEventHandler(eventType watch.EventType, old *v1.Pod, new *v1
 	}
 }
 
-func (r *Runner) onPodAdd(pod *v1.Pod) {
-	name, ok := pod.Labels[labelNetSetName]
-	if !ok {
+// startPodEventSpan starts the root span of the handling of a pod event, which
+// the syncs of the sets it alters are linked to
+func startPodEventSpan(name string, eventType watch.EventType, old, new *v1.Pod) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{attribute.String("event", string(eventType))}
+	pod := new
+	if pod == nil {
+		pod = old
+	}
+	if pod != nil {
+		attrs = append(attrs,
+			attribute.String("namespace", pod.Namespace),
+			attribute.String("pod", pod.Name),
+			attribute.String("ip", pod.Status.PodIP),
+		)
+	}
+	return tracing.Start(context.Background(), name,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+func (r *Runner) onPodAdd(ctx context.Context, pod *v1.Pod) {
+	names := podNetSetNames(pod)
+	if len(names) == 0 {
 		log.Logger.Error("Could not find label for pod", "label", labelNetSetName, "pod", pod.Name)
 		return
 	}
-	if pod.Status.PodIP != "" {
-		r.nsStore.AddNet(name, pod.Namespace, fmt.Sprintf("%s/32", pod.Status.PodIP))
-		if r.canSync {
-			r.nsStore.EnqueueNetSetSync(name, pod.Namespace)
+	if pod.Status.PodIP == "" {
+		return
+	}
+	labels := r.podPropagatedLabels(pod)
+	for _, name := range names {
+		_, reclaimedFrom := r.nsStore.AddNet(name, pod.Namespace, podNet(pod), pod.Name, audit.ReasonAdd)
+		r.nsStore.SetNetLabels(name, pod.Namespace, podNet(pod), labels)
+		if r.canSync.Load() {
+			r.nsStore.EnqueueNetSetSync(ctx, name, pod.Namespace)
+			r.nsStore.EnqueueSync(ctx, reclaimedFrom...)
 		}
 	}
 }
 
-func (r *Runner) onPodModify(old *v1.Pod, new *v1.Pod) {
-	name, ok := new.Labels[labelNetSetName]
-	if !ok {
+func (r *Runner) onPodModify(ctx context.Context, old *v1.Pod, new *v1.Pod) {
+	oldNames := podNetSetNames(old)
+	newNames := podNetSetNames(new)
+	ipChanged := new.Status.PodIP != old.Status.PodIP
+	var altered, reclaimed []string
+	// Remove the old address from sets the pod left, or from all of its
+	// previous sets if the address itself changed. A pod that lost all of
+	// its set names leaves all of its previous sets.
+	if old.Status.PodIP != "" {
+		for _, name := range oldNames {
+			if _, kept := inSlice(newNames, name); kept && !ipChanged {
+				continue
+			}
+			r.nsStore.DeleteNet(name, old.Namespace, podNet(old), audit.ReasonModify)
+			altered = append(altered, name)
+		}
+	}
+	if len(newNames) == 0 {
 		log.Logger.Error("Could not find label for pod", "label", labelNetSetName, "pod", new.Name)
-		return
 	}
-	altered := false
-	if new.Status.PodIP != "" && new.Status.PodIP != old.Status.PodIP {
-		r.nsStore.AddNet(name, new.Namespace, fmt.Sprintf("%s/32", new.Status.PodIP))
-		if old.Status.PodIP != "" {
-			r.nsStore.DeleteNet(name, new.Namespace, fmt.Sprintf("%s/32", old.Status.PodIP))
+	// Add the current address to sets the pod joined, or to all of its sets
+	// if the address changed.
+	if new.Status.PodIP != "" {
+		for _, name := range newNames {
+			if _, existed := inSlice(oldNames, name); existed && !ipChanged {
+				continue
+			}
+			_, reclaimedFrom := r.nsStore.AddNet(name, new.Namespace, podNet(new), new.Name, audit.ReasonModify)
+			reclaimed = append(reclaimed, reclaimedFrom...)
+			if _, found := inSlice(altered, name); !found {
+				altered = append(altered, name)
+			}
+		}
+		// Propagated labels may have changed without any change in
+		// membership
+		labels := r.podPropagatedLabels(new)
+		for _, name := range newNames {
+			if r.nsStore.SetNetLabels(name, new.Namespace, podNet(new), labels) {
+				if _, found := inSlice(altered, name); !found {
+					altered = append(altered, name)
+				}
+			}
+		}
+	}
+	if r.canSync.Load() {
+		for _, name := range altered {
+			r.nsStore.EnqueueNetSetSync(ctx, name, new.Namespace)
 		}
-		altered = true
+		r.nsStore.EnqueueSync(ctx, reclaimed...)
 	}
-	if new.Status.PodIP == "" && old.Status.PodIP != "" {
-		r.nsStore.DeleteNet(name, new.Namespace, fmt.Sprintf("%s/32", old.Status.PodIP))
-		altered = true
+}
+
+func (r *Runner) onPodDelete(ctx context.Context, pod *v1.Pod) {
+	names := podNetSetNames(pod)
+	if len(names) == 0 {
+		log.Logger.Error("Could not find label for pod", "label", labelNetSetName, "pod", pod.Name)
+		return
 	}
-	if altered {
-		if r.canSync {
-			r.nsStore.EnqueueNetSetSync(name, new.Namespace)
+	if pod.Status.PodIP == "" {
+		return
+	}
+	for _, name := range names {
+		r.nsStore.DeleteNet(name, pod.Namespace, podNet(pod), audit.ReasonDelete)
+		if r.canSync.Load() {
+			r.nsStore.EnqueueNetSetSync(ctx, name, pod.Namespace)
+		}
+	}
+}
+
+// NamespaceEventHandler starts and stops watching the pods of namespaces that
+// are exported as a whole. Namespaces that lose the export label are seen as
+// deleted, since they no longer match the watcher label selector.
+func (r *Runner) NamespaceEventHandler(eventType watch.EventType, old *v1.Namespace, new *v1.Namespace) {
+	switch eventType {
+	case watch.Added:
+		log.Logger.Debug("Received namespace add event", "namespace", new.Name)
+		if !r.namespaceWatched(new.Name) || !r.namespaceFilter.allowed(new.Name) {
+			log.Logger.Info("Ignoring export label of filtered out namespace", "namespace", new.Name)
+			return
+		}
+		r.startNamespacePodWatcher(new.Name)
+	case watch.Modified:
+		// Only the export label matters, which is handled by add and
+		// delete events
+	case watch.Deleted:
+		log.Logger.Debug("Received namespace delete event", "namespace", old.Name)
+		r.stopNamespacePodWatcher(old.Name)
+		if r.canSync.Load() {
+			r.nsStore.EnqueueNamespaceNetSetSync(context.Background(), old.Name)
 		}
+	default:
+		log.Logger.Info(
+			"Unknown namespace event received: %v",
+			eventType,
+		)
 	}
+}
 
+func (r *Runner) startNamespacePodWatcher(namespace string) {
+	r.namespacePodWatchersMu.Lock()
+	defer r.namespacePodWatchersMu.Unlock()
+	if _, ok := r.namespacePodWatchers[namespace]; ok {
+		return
+	}
+	pw := kube.NewPodWatcher(
+		r.watchClient,
+		r.podResyncPeriod,
+		r.NamespacePodEventHandler,
+		r.podAllowed,
+		kube.PodProjection(labelPrefix),
+		"",
+		namespace,
+	)
+	pw.Init()
+	r.namespacePodWatchers[namespace] = pw
+	r.namespacePodWatchersWG.Add(1)
+	go func() {
+		defer r.namespacePodWatchersWG.Done()
+		pw.Run()
+	}()
 }
 
-func (r *Runner) onPodDelete(pod *v1.Pod) {
-	name, ok := pod.Labels[labelNetSetName]
+// stopNamespacePodWatcher stops watching the pods of a namespace and deletes
+// its set from the store. Both happen under the lock of the watchers, so that
+// events still in flight from the watcher cannot recreate the set.
+func (r *Runner) stopNamespacePodWatcher(namespace string) {
+	r.namespacePodWatchersMu.Lock()
+	defer r.namespacePodWatchersMu.Unlock()
+	r.nsStore.DeleteNamespaceNetworkSet(namespace)
+	pw, ok := r.namespacePodWatchers[namespace]
 	if !ok {
-		log.Logger.Error("Could not find label for pod", "label", labelNetSetName, "pod", pod.Name)
 		return
 	}
-	if pod.Status.PodIP != "" {
-		r.nsStore.DeleteNet(name, pod.Namespace, fmt.Sprintf("%s/32", pod.Status.PodIP))
-		if r.canSync {
-			r.nsStore.EnqueueNetSetSync(name, pod.Namespace)
+	pw.Stop()
+	delete(r.namespacePodWatchers, namespace)
+}
+
+// stopNamespacePodWatchers stops the pod watchers of all the exported
+// namespaces and waits for them to return
+func (r *Runner) stopNamespacePodWatchers() {
+	r.namespacePodWatchersMu.Lock()
+	for namespace, pw := range r.namespacePodWatchers {
+		pw.Stop()
+		delete(r.namespacePodWatchers, namespace)
+	}
+	r.namespacePodWatchersMu.Unlock()
+	r.namespacePodWatchersWG.Wait()
+}
+
+// namespaceExported returns true while the pods of the namespace are watched
+func (r *Runner) namespaceExported(namespace string) bool {
+	r.namespacePodWatchersMu.Lock()
+	defer r.namespacePodWatchersMu.Unlock()
+	_, ok := r.namespacePodWatchers[namespace]
+	return ok
+}
+
+func (r *Runner) namespacePodWatchersSynced() bool {
+	r.namespacePodWatchersMu.Lock()
+	defer r.namespacePodWatchersMu.Unlock()
+	for _, pw := range r.namespacePodWatchers {
+		if !pw.HasSynced() {
+			return false
 		}
 	}
+	return true
+}
+
+// NamespacePodEventHandler keeps the set of an exported namespace up to date
+// with the addresses of its running pods.
+func (r *Runner) NamespacePodEventHandler(eventType watch.EventType, old *v1.Pod, new *v1.Pod) {
+	ctx, span := startPodEventSpan("namespace pod event", eventType, old, new)
+	defer span.End()
+	var namespace, oldNet, newNet string
+	var reason audit.Reason
+	switch eventType {
+	case watch.Added:
+		namespace, newNet = new.Namespace, runningPodNet(new)
+		reason = audit.ReasonAdd
+	case watch.Modified:
+		namespace, oldNet, newNet = new.Namespace, runningPodNet(old), runningPodNet(new)
+		reason = audit.ReasonModify
+	case watch.Deleted:
+		namespace, oldNet = old.Namespace, runningPodNet(old)
+		reason = audit.ReasonDelete
+	default:
+		log.Logger.Info(
+			"Unknown namespace pod event received: %v",
+			eventType,
+		)
+		return
+	}
+	if oldNet == newNet {
+		return
+	}
+	// Events may still arrive from a watcher that is being stopped, so the
+	// store is only updated while the namespace is exported
+	r.namespacePodWatchersMu.Lock()
+	if _, ok := r.namespacePodWatchers[namespace]; !ok {
+		r.namespacePodWatchersMu.Unlock()
+		return
+	}
+	if oldNet != "" {
+		r.nsStore.DeleteNamespaceNet(namespace, oldNet, reason)
+	}
+	var reclaimedFrom []string
+	if newNet != "" {
+		_, reclaimedFrom = r.nsStore.AddNamespaceNet(namespace, newNet, new.Name, reason)
+	}
+	r.namespacePodWatchersMu.Unlock()
+	if r.canSync.Load() {
+		r.nsStore.EnqueueNamespaceNetSetSync(ctx, namespace)
+		r.nsStore.EnqueueSync(ctx, reclaimedFrom...)
+	}
+}
+
+// runningPodNet returns the pod IP address as a /32 net if the pod is running
+// and has its own address, or an empty string otherwise.
+func runningPodNet(pod *v1.Pod) string {
+	if pod.Status.PodIP == "" || pod.Spec.HostNetwork {
+		return ""
+	}
+	if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+		return ""
+	}
+	return podNet(pod)
+}
+
+// NamespaceLabelsEventHandler keeps track of the remote namespace labels that
+// should be propagated to the sets of each namespace.
+func (r *Runner) NamespaceLabelsEventHandler(eventType watch.EventType, old *v1.Namespace, new *v1.Namespace) {
+	var ids []string
+	switch eventType {
+	case watch.Added, watch.Modified:
+		ids = r.nsStore.SetNamespaceLabels(new.Name, selectLabels(new.Labels, r.propagateNamespaceLabels))
+	case watch.Deleted:
+		ids = r.nsStore.SetNamespaceLabels(old.Name, nil)
+	default:
+		log.Logger.Info(
+			"Unknown namespace event received: %v",
+			eventType,
+		)
+	}
+	if r.canSync.Load() {
+		for _, id := range ids {
+			r.nsStore.enqueue(context.Background(), id)
+		}
+	}
+}
+
+// namespaceWatched returns true if the namespace is among the watched ones,
+// or if all namespaces are watched
+func (r *Runner) namespaceWatched(namespace string) bool {
+	if len(r.watchNamespaces) == 0 {
+		return true
+	}
+	_, found := inSlice(r.watchNamespaces, namespace)
+	return found
+}
+
+// podAllowed returns false for pods that have opted out via annotation or
+// that live in a filtered out namespace
+func (r *Runner) podAllowed(pod *v1.Pod) bool {
+	if pod.Annotations[annotationExclude] == "true" {
+		return false
+	}
+	return r.namespaceFilter.allowed(pod.Namespace)
+}
+
+// podPropagatedLabels returns the labels of the pod that should be copied onto
+// its sets
+func (r *Runner) podPropagatedLabels(pod *v1.Pod) map[string]string {
+	return selectLabels(pod.Labels, r.propagatePodLabels)
+}
+
+// selectLabels returns the subset of labels with the given keys
+func selectLabels(labels map[string]string, keys []string) map[string]string {
+	selected := make(map[string]string)
+	for _, k := range keys {
+		if v, ok := labels[k]; ok {
+			selected[k] = v
+		}
+	}
+	return selected
+}
+
+// propagatableLabelKeys filters out label keys that would clash with the
+// labels managed by the operator
+func propagatableLabelKeys(keys []string) []string {
+	var allowed []string
+	for _, k := range keys {
+		if k == labelManagedBy || strings.HasPrefix(k, labelPrefix) {
+			log.Logger.Warn("Ignoring reserved label key in propagation list", "label", k)
+			continue
+		}
+		allowed = append(allowed, k)
+	}
+	return allowed
+}
+
+// podNetSetNames returns the names of all the network sets a pod is a member
+// of. These are the value of the labelNetSetName label plus the values of any
+// labels prefixed with labelNetSetName followed by a dot, eg:
+// `policy.semaphore.uw.io/name.sidecar`. The result is sorted and contains no
+// duplicates.
+func podNetSetNames(pod *v1.Pod) []string {
+	var names []string
+	for key, value := range pod.Labels {
+		if value == "" {
+			continue
+		}
+		if key != labelNetSetName && !strings.HasPrefix(key, labelNetSetName+".") {
+			continue
+		}
+		if _, found := inSlice(names, value); !found {
+			names = append(names, value)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// podNet returns the pod IP address as a /32 net
+func podNet(pod *v1.Pod) string {
+	return fmt.Sprintf("%s/32", pod.Status.PodIP)
 }
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	clientfeatures "k8s.io/client-go/features"
+	clientfeaturestesting "k8s.io/client-go/features/testing"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/utilitywarehouse/semaphore-policy/kube"
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+func testPod(name, ip string, labels map[string]string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "namespace",
+			Labels:    labels,
+		},
+		Status: v1.PodStatus{PodIP: ip},
+	}
+}
+
+func TestPodNetSetNames(t *testing.T) {
+	pod := testPod("pod", "10.0.0.1", map[string]string{
+		labelNetSetName:              "app",
+		labelNetSetName + ".sidecar": "shared",
+		labelNetSetName + ".other":   "app",
+		labelNetSetName + ".empty":   "",
+		labelNetSetName + "x":        "ignored",
+		"app":                        "ignored",
+	})
+	assert.Equal(t, []string{"app", "shared"}, podNetSetNames(pod))
+}
+
+func TestRunnerMultipleMemberships(t *testing.T) {
+	log.InitLogger("test", "debug")
+	r := &Runner{
+		nsStore: &NetworkSetStore{
+			store:   make(map[string]*NetworkSet),
+			cluster: "test",
+		},
+	}
+	appID := makeNetworkSetID("app", "namespace", "test")
+	sharedID := makeNetworkSetID("shared", "namespace", "test")
+	otherID := makeNetworkSetID("other", "namespace", "test")
+
+	// Pod added to two sets
+	pod := testPod("pod", "10.0.0.1", map[string]string{
+		labelNetSetName:              "app",
+		labelNetSetName + ".sidecar": "shared",
+	})
+	r.onPodAdd(context.Background(), pod)
+	assert.Equal(t, 2, len(r.nsStore.store))
+	assert.Equal(t, []string{"10.0.0.1/32"}, r.nsStore.store[appID].nets)
+	assert.Equal(t, []string{"10.0.0.1/32"}, r.nsStore.store[sharedID].nets)
+
+	// Pod leaves a set and joins another one
+	modified := testPod("pod", "10.0.0.1", map[string]string{
+		labelNetSetName:              "app",
+		labelNetSetName + ".sidecar": "other",
+	})
+	r.onPodModify(context.Background(), pod, modified)
+	assert.Equal(t, 2, len(r.nsStore.store))
+	assert.Equal(t, []string{"10.0.0.1/32"}, r.nsStore.store[appID].nets)
+	assert.Equal(t, []string{"10.0.0.1/32"}, r.nsStore.store[otherID].nets)
+	assert.Nil(t, r.nsStore.store[sharedID])
+
+	// Pod IP changes, all memberships should follow
+	moved := testPod("pod", "10.0.0.2", modified.Labels)
+	r.onPodModify(context.Background(), modified, moved)
+	assert.Equal(t, []string{"10.0.0.2/32"}, r.nsStore.store[appID].nets)
+	assert.Equal(t, []string{"10.0.0.2/32"}, r.nsStore.store[otherID].nets)
+
+	// Another pod in one of the sets
+	pod2 := testPod("pod2", "10.0.0.3", map[string]string{
+		labelNetSetName: "other",
+	})
+	r.onPodAdd(context.Background(), pod2)
+	assert.Equal(t, []string{"10.0.0.2/32", "10.0.0.3/32"}, r.nsStore.store[otherID].nets)
+
+	// Deleting the first pod removes it from all its sets
+	r.onPodDelete(context.Background(), moved)
+	assert.Equal(t, 1, len(r.nsStore.store))
+	assert.Equal(t, []string{"10.0.0.3/32"}, r.nsStore.store[otherID].nets)
+
+	// A pod that loses all of its set names leaves all of its sets
+	unlabelled := testPod("pod2", "10.0.0.3", map[string]string{
+		labelNetSetName: "",
+	})
+	r.onPodModify(context.Background(), pod2, unlabelled)
+	assert.Equal(t, 0, len(r.nsStore.store))
+}
+
+func TestRunnerReclaimedNetWaitsForSync(t *testing.T) {
+	log.InitLogger("test", "debug")
+	r := &Runner{
+		nsStore: &NetworkSetStore{
+			store:           make(map[string]*NetworkSet),
+			cluster:         "test",
+			syncQueue:       make(chan SyncObject, 2),
+			removalHoldDown: time.Hour,
+		},
+	}
+	appID := makeNetworkSetID("app", "namespace", "test")
+	pod := testPod("pod", "10.0.0.1", map[string]string{labelNetSetName: "app"})
+	r.onPodAdd(context.Background(), pod)
+	r.onPodDelete(context.Background(), pod)
+
+	// The set the net is reclaimed from is not queued before the first
+	// full sync
+	r.onPodAdd(context.Background(), testPod("pod2", "10.0.0.1", map[string]string{labelNetSetName: "other"}))
+	assert.Nil(t, r.nsStore.store[appID])
+	assert.Equal(t, 0, len(r.nsStore.syncQueue))
+
+	// and queued once syncs are allowed
+	r.canSync.Store(true)
+	r.onPodDelete(context.Background(), testPod("pod2", "10.0.0.1", map[string]string{labelNetSetName: "other"}))
+	<-r.nsStore.syncQueue
+	r.onPodAdd(context.Background(), pod)
+	o := <-r.nsStore.syncQueue
+	assert.Equal(t, appID, o.id)
+	o = <-r.nsStore.syncQueue
+	assert.Equal(t, makeNetworkSetID("other", "namespace", "test"), o.id)
+}
+
+func TestRunnerNamespaceSets(t *testing.T) {
+	log.InitLogger("test", "debug")
+	r := &Runner{
+		nsStore: &NetworkSetStore{
+			store:   make(map[string]*NetworkSet),
+			cluster: "test",
+		},
+		namespacePodWatchers: map[string]*kube.PodWatcher{
+			"namespace": kube.NewPodWatcher(nil, 0, nil, nil, nil, "", "namespace"),
+		},
+	}
+	id := makeNamespaceNetworkSetID("namespace", "test")
+	expectedLabels := map[string]string{
+		labelManagedBy:       valueManagedBy,
+		labelNetSetCluster:   "test",
+		labelNetSetNamespace: "namespace",
+		labelNetSetScope:     valueScopeNamespace,
+	}
+
+	// Pods do not need the policy label
+	pod := testPod("pod", "10.0.0.1", nil)
+	r.NamespacePodEventHandler(watch.Added, nil, pod)
+	pod2 := testPod("pod2", "10.0.0.2", nil)
+	r.NamespacePodEventHandler(watch.Added, nil, pod2)
+	assert.Equal(t, []string{"10.0.0.1/32", "10.0.0.2/32"}, r.nsStore.store[id].nets)
+	assert.Equal(t, expectedLabels, r.nsStore.store[id].labels)
+
+	// Host network pods are ignored
+	hostPod := testPod("host", "192.168.0.1", nil)
+	hostPod.Spec.HostNetwork = true
+	r.NamespacePodEventHandler(watch.Added, nil, hostPod)
+	assert.Equal(t, []string{"10.0.0.1/32", "10.0.0.2/32"}, r.nsStore.store[id].nets)
+
+	// Completed pods are removed
+	completed := testPod("pod", "10.0.0.1", nil)
+	completed.Status.Phase = v1.PodSucceeded
+	r.NamespacePodEventHandler(watch.Modified, pod, completed)
+	assert.Equal(t, []string{"10.0.0.2/32"}, r.nsStore.store[id].nets)
+
+	// Pods of namespaces that are not exported are ignored
+	other := testPod("other", "10.0.0.3", nil)
+	other.Namespace = "other"
+	r.NamespacePodEventHandler(watch.Added, nil, other)
+	assert.Equal(t, 1, len(r.nsStore.store))
+
+	// Unexporting the namespace drops the whole set
+	r.NamespaceEventHandler(watch.Deleted, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace"}}, nil)
+	assert.Equal(t, 0, len(r.nsStore.store))
+	assert.False(t, r.namespaceExported("namespace"))
+
+	// and events still in flight from its watcher do not recreate it
+	r.NamespacePodEventHandler(watch.Modified, pod2, testPod("pod2", "10.0.0.4", nil))
+	assert.Equal(t, 0, len(r.nsStore.store))
+}
+
+func TestRunnerNamespacePodWatchers(t *testing.T) {
+	log.InitLogger("test", "debug")
+	// the fake clientset does not support streaming the initial list
+	clientfeaturestesting.SetFeatureDuringTest(t, clientfeatures.WatchListClient, false)
+	podIn := func(namespace, name, ip string) *v1.Pod {
+		pod := testPod(name, ip, nil)
+		pod.Namespace = namespace
+		return pod
+	}
+	namespace := func(name string) *v1.Namespace {
+		return &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+	client := fake.NewClientset(
+		podIn("a", "pod", "10.0.0.1"),
+		podIn("b", "pod", "10.0.0.2"),
+		podIn("kube-system", "pod", "10.0.0.3"),
+	)
+	r := &Runner{
+		nsStore: &NetworkSetStore{
+			store:   make(map[string]*NetworkSet),
+			cluster: "test",
+		},
+		namespacePodWatchers: make(map[string]*kube.PodWatcher),
+		watchClient:          client,
+		watchNamespaces:      []string{"a", "kube-system"},
+		namespaceFilter:      namespaceFilter{deny: []string{"kube-system"}},
+	}
+	defer r.stopNamespacePodWatchers()
+	setOf := func(namespace string) []string {
+		_, nets, _ := r.nsStore.get(makeNamespaceNetworkSetID(namespace, "test"))
+		return nets
+	}
+
+	// Exported namespaces get a pod watcher, once
+	r.NamespaceEventHandler(watch.Added, nil, namespace("a"))
+	assert.True(t, r.namespaceExported("a"))
+	pw := r.namespacePodWatchers["a"]
+	r.NamespaceEventHandler(watch.Added, nil, namespace("a"))
+	assert.Same(t, pw, r.namespacePodWatchers["a"])
+	assert.Eventually(t, func() bool { return len(setOf("a")) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"10.0.0.1/32"}, setOf("a"))
+	assert.Eventually(t, r.namespacePodWatchersSynced, time.Second, 10*time.Millisecond)
+
+	// Namespaces not watched or filtered out are not exported
+	r.NamespaceEventHandler(watch.Added, nil, namespace("b"))
+	r.NamespaceEventHandler(watch.Added, nil, namespace("kube-system"))
+	assert.False(t, r.namespaceExported("b"))
+	assert.False(t, r.namespaceExported("kube-system"))
+	assert.Equal(t, 1, len(r.namespacePodWatchers))
+
+	// Namespaces no longer exported stop their watcher and lose their set
+	r.NamespaceEventHandler(watch.Deleted, namespace("a"), nil)
+	assert.False(t, r.namespaceExported("a"))
+	assert.Nil(t, setOf("a"))
+	_, err := client.CoreV1().Pods("a").Create(context.Background(), podIn("a", "pod2", "10.0.0.4"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, setOf("a"))
+
+	// and get a new one when exported again
+	r.NamespaceEventHandler(watch.Added, nil, namespace("a"))
+	assert.NotSame(t, pw, r.namespacePodWatchers["a"])
+	assert.Eventually(t, func() bool { return len(setOf("a")) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"10.0.0.1/32", "10.0.0.4/32"}, setOf("a"))
+}
+
+func TestRunnerPropagatedPodLabels(t *testing.T) {
+	log.InitLogger("test", "debug")
+	r := &Runner{
+		nsStore: &NetworkSetStore{
+			store:   make(map[string]*NetworkSet),
+			cluster: "test",
+		},
+		propagatePodLabels: propagatableLabelKeys([]string{"team", labelNetSetNamespace}),
+	}
+	assert.Equal(t, []string{"team"}, r.propagatePodLabels)
+	id := makeNetworkSetID("app", "namespace", "test")
+
+	pod := testPod("pod", "10.0.0.1", map[string]string{
+		labelNetSetName: "app",
+		"team":          "a",
+		"other":         "ignored",
+	})
+	r.onPodAdd(context.Background(), pod)
+	labels, _, _ := r.nsStore.get(id)
+	assert.Equal(t, "a", labels["team"])
+	_, ok := labels["other"]
+	assert.False(t, ok)
+
+	// A label change alone is picked up
+	relabelled := testPod("pod", "10.0.0.1", map[string]string{
+		labelNetSetName: "app",
+		"team":          "b",
+	})
+	r.onPodModify(context.Background(), pod, relabelled)
+	labels, _, _ = r.nsStore.get(id)
+	assert.Equal(t, "b", labels["team"])
+}
+
+func TestRunnerPodAllowed(t *testing.T) {
+	r := &Runner{
+		namespaceFilter: namespaceFilter{
+			deny: []string{"kube-system"},
+		},
+	}
+	pod := testPod("pod", "10.0.0.1", nil)
+	assert.True(t, r.podAllowed(pod))
+
+	pod.Annotations = map[string]string{annotationExclude: "true"}
+	assert.False(t, r.podAllowed(pod))
+
+	pod = testPod("pod", "10.0.0.1", nil)
+	pod.Namespace = "kube-system"
+	assert.False(t, r.podAllowed(pod))
+
+	r.namespaceFilter = namespaceFilter{
+		allow: []string{"namespace", "kube-system"},
+		deny:  []string{"kube-system"},
+	}
+	assert.False(t, r.podAllowed(pod))
+	pod.Namespace = "namespace"
+	assert.True(t, r.podAllowed(pod))
+	pod.Namespace = "other"
+	assert.False(t, r.podAllowed(pod))
+}
+
+func TestRunnerReadiness(t *testing.T) {
+	log.InitLogger("test", "debug")
+	r := &Runner{
+		nsStore: &NetworkSetStore{
+			store:   make(map[string]*NetworkSet),
+			cluster: "test",
+		},
+	}
+	status := r.Readiness(time.Minute, time.Minute)
+	assert.False(t, status.Ready)
+	assert.Equal(t, []string{"initial sync in progress"}, status.Reasons)
+
+	r.canSync.Store(true)
+	assert.True(t, r.Readiness(time.Minute, time.Minute).Ready)
+
+	// A sync task running for too long makes the runner not ready
+	r.nsStore.setBusy(true)
+	r.nsStore.busySince = time.Now().Add(-2 * time.Minute)
+	status = r.Readiness(time.Minute, time.Minute)
+	assert.False(t, status.Ready)
+	assert.True(t, status.SyncLoop.Busy)
+	assert.True(t, r.Readiness(time.Minute, 0).Ready)
+
+	r.nsStore.setBusy(false)
+	assert.True(t, r.Readiness(time.Minute, time.Minute).Ready)
+}
+
+func TestRunnerWaitForCacheSync(t *testing.T) {
+	log.InitLogger("test", "debug")
+	r := &Runner{
+		stop:      make(chan struct{}),
+		cacheSync: cacheSyncConfig{timeout: 10 * time.Millisecond, policy: cacheSyncPolicyFail},
+	}
+	never := func() bool { return false }
+	ok, err := r.waitForCacheSync("test", never)
+	assert.False(t, ok)
+	assert.Error(t, err)
+	assert.Equal(t, 1, r.startup.status().Timeouts)
+
+	// The retry policy keeps waiting until the cache syncs
+	r = &Runner{
+		stop:      make(chan struct{}),
+		cacheSync: cacheSyncConfig{timeout: 10 * time.Millisecond, policy: cacheSyncPolicyRetry},
+	}
+	deadline := time.Now().Add(300 * time.Millisecond)
+	ok, err = r.waitForCacheSync("test", func() bool { return time.Now().After(deadline) })
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.Greater(t, r.startup.status().Timeouts, 0)
+	assert.Equal(t, "", r.startup.status().WaitingFor)
+
+	// Stopping the runner aborts the wait without an error
+	r = &Runner{
+		stop:      make(chan struct{}),
+		cacheSync: cacheSyncConfig{policy: cacheSyncPolicyRetry},
+	}
+	close(r.stop)
+	ok, err = r.waitForCacheSync("test", never)
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	assert.Error(t, cacheSyncConfig{policy: "wait"}.validate())
+	assert.NoError(t, cacheSyncConfig{policy: cacheSyncPolicyFail}.validate())
+}
+
+func TestRunnerFullSyncs(t *testing.T) {
+	r := &Runner{
+		nsStore:        &NetworkSetStore{fullSyncQueue: make(chan struct{})},
+		stop:           make(chan struct{}),
+		fullSyncPeriod: 10 * time.Millisecond,
+	}
+	done := make(chan struct{})
+	go func() {
+		r.runFullSyncs()
+		close(done)
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-r.nsStore.fullSyncQueue:
+		case <-time.After(time.Second):
+			t.Fatal("full sync not queued")
+		}
+	}
+	close(r.stop)
+	<-done
+}
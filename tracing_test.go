@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/utilitywarehouse/semaphore-policy/log"
+	"github.com/utilitywarehouse/semaphore-policy/tracing"
+)
+
+func testTracer(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return exporter
+}
+
+func spanByName(spans tracetest.SpanStubs, name string) (tracetest.SpanStub, bool) {
+	for _, s := range spans {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+func TestTracingPodEvent(t *testing.T) {
+	log.InitLogger("test", "debug")
+	exporter := testTracer(t)
+	r := &Runner{
+		nsStore: &NetworkSetStore{
+			store:     make(map[string]*NetworkSet),
+			cluster:   "test",
+			syncQueue: make(chan SyncObject),
+		},
+	}
+	r.canSync.Store(true)
+
+	queued := make(chan SyncObject)
+	go func() { queued <- <-r.nsStore.syncQueue }()
+	r.PodEventHandler(watch.Added, nil, testPod("pod", "10.0.0.1", map[string]string{labelNetSetName: "app"}))
+	o := <-queued
+
+	spans := exporter.GetSpans()
+	event, ok := spanByName(spans, "pod event")
+	assert.True(t, ok)
+	enqueue, ok := spanByName(spans, "enqueue")
+	assert.True(t, ok)
+	// the wait for the sync loop is part of the pod event trace, and the
+	// queue item carries it to the sync
+	assert.Equal(t, event.SpanContext.SpanID(), enqueue.Parent.SpanID())
+	assert.Equal(t, enqueue.SpanContext, o.link)
+	assert.Equal(t, makeNetworkSetID("app", "namespace", "test"), o.id)
+}
+
+func TestTracingRequeue(t *testing.T) {
+	log.InitLogger("test", "debug")
+	exporter := testTracer(t)
+	nss := &NetworkSetStore{
+		store:     make(map[string]*NetworkSet),
+		cluster:   "test",
+		syncQueue: make(chan SyncObject),
+	}
+	id := makeNetworkSetID("app", "namespace", "test")
+
+	// A failed sync records the retry as an event
+	ctx, span := tracing.Start(context.Background(), "sync")
+	nss.requeue(ctx, id)
+	span.End()
+	o := <-nss.syncQueue
+	assert.Equal(t, id, o.id)
+
+	sync, ok := spanByName(exporter.GetSpans(), "sync")
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(sync.Events))
+	assert.Equal(t, "requeue", sync.Events[0].Name)
+	assert.Eventually(t, func() bool {
+		enqueue, ok := spanByName(exporter.GetSpans(), "enqueue")
+		return ok && enqueue.Parent.SpanID() == sync.SpanContext.SpanID()
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,329 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/utilitywarehouse/semaphore-policy/log"
+	"github.com/utilitywarehouse/semaphore-policy/metrics"
+)
+
+// Headers of the deliveries. The signature is the hex encoded HMAC-SHA256 of
+// the timestamp, a dot and the body, keyed with the secret of the webhook.
+const (
+	HeaderDelivery  = "X-Semaphore-Delivery"
+	HeaderTimestamp = "X-Semaphore-Timestamp"
+	HeaderSignature = "X-Semaphore-Signature"
+)
+
+// Duration is a time.Duration that is configured as a string, e.g. "10s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Config configures a webhook
+type Config struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// SecretFile is the path of the file with the secret used to sign the
+	// deliveries
+	SecretFile string `json:"secretFile"`
+	// Selector limits the notifications to the sets with all these labels
+	Selector map[string]string `json:"selector,omitempty"`
+	// Timeout bounds each delivery attempt
+	Timeout Duration `json:"timeout,omitempty"`
+	// MaxAttempts is the number of attempts of a delivery before it is
+	// dropped, retried after MinBackoff, doubling up to MaxBackoff
+	MaxAttempts int      `json:"maxAttempts,omitempty"`
+	MinBackoff  Duration `json:"minBackoff,omitempty"`
+	MaxBackoff  Duration `json:"maxBackoff,omitempty"`
+	// QueueSize is the number of notifications waiting for delivery, after
+	// which new ones are dropped
+	QueueSize int `json:"queueSize,omitempty"`
+	// Secret is read from SecretFile
+	Secret []byte `json:"-"`
+}
+
+func (c *Config) setDefaults() {
+	if c.Timeout == 0 {
+		c.Timeout = Duration(10 * time.Second)
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = 5
+	}
+	if c.MinBackoff == 0 {
+		c.MinBackoff = Duration(time.Second)
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = Duration(time.Minute)
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = 100
+	}
+}
+
+func (c *Config) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("webhook name is required")
+	}
+	if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		return fmt.Errorf("webhook %s: url must be http or https, got %q", c.Name, c.URL)
+	}
+	if len(c.Secret) == 0 {
+		return fmt.Errorf("webhook %s: a secret is required", c.Name)
+	}
+	if c.Timeout < 0 || c.MaxAttempts < 0 || c.MinBackoff < 0 || c.MaxBackoff < c.MinBackoff || c.QueueSize < 0 {
+		return fmt.Errorf("webhook %s: invalid delivery settings", c.Name)
+	}
+	return nil
+}
+
+// LoadConfig reads the webhooks from a YAML or JSON file holding a list of
+// them, along with their secrets
+func LoadConfig(path string) ([]Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read webhooks config: %v", err)
+	}
+	var configs []Config
+	if err := yaml.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("cannot parse webhooks config: %v", err)
+	}
+	names := make(map[string]bool)
+	for i := range configs {
+		c := &configs[i]
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicate webhook name %q", c.Name)
+		}
+		names[c.Name] = true
+		if c.SecretFile == "" {
+			return nil, fmt.Errorf("webhook %s: secretFile is required", c.Name)
+		}
+		secret, err := os.ReadFile(c.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: cannot read secret: %v", c.Name, err)
+		}
+		c.Secret = bytes.TrimSpace(secret)
+	}
+	return configs, nil
+}
+
+// Change is the payload of a notification: the full current nets of a set
+// and the nets added and removed by the sync
+type Change struct {
+	Set     string            `json:"set"`
+	Cluster string            `json:"cluster"`
+	Action  string            `json:"action"`
+	Labels  map[string]string `json:"labels"`
+	Nets    []string          `json:"nets"`
+	Added   []string          `json:"added"`
+	Removed []string          `json:"removed"`
+	Time    time.Time         `json:"time"`
+}
+
+// Notifier delivers the changes of the sets to the webhooks. A nil Notifier
+// discards them.
+type Notifier struct {
+	hooks  []*hook
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type hook struct {
+	Config
+	client *http.Client
+	queue  chan Change
+}
+
+// New returns a Notifier for the webhooks, which delivers once started
+func New(configs []Config) (*Notifier, error) {
+	n := &Notifier{}
+	for _, c := range configs {
+		c.setDefaults()
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+		n.hooks = append(n.hooks, &hook{
+			Config: c,
+			client: &http.Client{Timeout: time.Duration(c.Timeout)},
+			queue:  make(chan Change, c.QueueSize),
+		})
+	}
+	return n, nil
+}
+
+// Start starts a delivery worker per webhook. Deliveries to a webhook are
+// made in order, one at a time.
+func (n *Notifier) Start() {
+	if n == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n.cancel = cancel
+	for _, h := range n.hooks {
+		n.wg.Add(1)
+		go func(h *hook) {
+			defer n.wg.Done()
+			h.run(ctx)
+		}(h)
+	}
+}
+
+// Stop stops the workers, abandoning the pending deliveries
+func (n *Notifier) Stop() {
+	if n == nil || n.cancel == nil {
+		return
+	}
+	n.cancel()
+	n.wg.Wait()
+}
+
+// Notify queues a change for the webhooks whose selector matches the labels
+// of the set. Changes are dropped if the queue of a webhook is full, so that
+// a slow receiver cannot hold back the sync loop.
+func (n *Notifier) Notify(c Change) {
+	if n == nil {
+		return
+	}
+	if c.Time.IsZero() {
+		c.Time = time.Now().UTC()
+	}
+	for _, h := range n.hooks {
+		if !matches(h.Selector, c.Labels) {
+			continue
+		}
+		select {
+		case h.queue <- c:
+		default:
+			log.Webhook.Warn("webhook queue is full, dropping notification", "webhook", h.Name, "set", c.Set)
+			metrics.IncWebhookDeliveries(h.Name, "dropped")
+		}
+	}
+}
+
+func matches(selector, labels map[string]string) bool {
+	for k, v := range selector {
+		if l, ok := labels[k]; !ok || l != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *hook) run(ctx context.Context) {
+	for {
+		select {
+		case c := <-h.queue:
+			h.deliver(ctx, c)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver posts a change, retrying with backoff on connection errors, 429 and
+// 5xx responses
+func (h *hook) deliver(ctx context.Context, c Change) {
+	body, err := json.Marshal(c)
+	if err != nil {
+		log.Webhook.Error("failed to encode webhook payload", "webhook", h.Name, "err", err)
+		metrics.IncWebhookDeliveries(h.Name, "failure")
+		return
+	}
+	id := deliveryID()
+	backoff := time.Duration(h.MinBackoff)
+	for attempt := 1; ; attempt++ {
+		retry, err := h.post(ctx, id, body)
+		if err == nil {
+			metrics.IncWebhookDeliveries(h.Name, "success")
+			return
+		}
+		if !retry || attempt >= h.MaxAttempts {
+			log.Webhook.Error("webhook delivery failed", "webhook", h.Name, "set", c.Set, "delivery", id, "attempts", attempt, "err", err)
+			metrics.IncWebhookDeliveries(h.Name, "failure")
+			return
+		}
+		log.Webhook.Warn("webhook delivery failed, retrying", "webhook", h.Name, "set", c.Set, "delivery", id, "attempt", attempt, "backoff", backoff, "err", err)
+		metrics.IncWebhookDeliveryRetries(h.Name)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			metrics.IncWebhookDeliveries(h.Name, "dropped")
+			return
+		}
+		if backoff *= 2; backoff > time.Duration(h.MaxBackoff) {
+			backoff = time.Duration(h.MaxBackoff)
+		}
+	}
+}
+
+// post makes one delivery attempt and returns whether a failure can be
+// retried
+func (h *hook) post(ctx context.Context, id string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderDelivery, id)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(h.Secret, timestamp, body))
+	start := time.Now()
+	resp, err := h.client.Do(req)
+	metrics.ObserveWebhookDeliveryDuration(h.Name, start)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected response %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+}
+
+// Sign returns the signature of a delivery, for receivers to verify
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func deliveryID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
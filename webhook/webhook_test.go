@@ -0,0 +1,176 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/utilitywarehouse/semaphore-policy/log"
+)
+
+// receiver records the deliveries it accepts, and fails the first ones with
+// the given codes
+type receiver struct {
+	mu       sync.Mutex
+	codes    []int
+	attempts int
+	received chan Change
+	headers  chan http.Header
+	bodies   chan []byte
+}
+
+func newReceiver(codes ...int) *receiver {
+	return &receiver{
+		codes:    codes,
+		received: make(chan Change, 10),
+		headers:  make(chan http.Header, 10),
+		bodies:   make(chan []byte, 10),
+	}
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	rc.attempts++
+	code := http.StatusOK
+	if len(rc.codes) > 0 {
+		code, rc.codes = rc.codes[0], rc.codes[1:]
+	}
+	rc.mu.Unlock()
+	w.WriteHeader(code)
+	if code != http.StatusOK {
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var c Change
+	json.Unmarshal(body, &c)
+	rc.headers <- r.Header
+	rc.bodies <- body
+	rc.received <- c
+}
+
+func (rc *receiver) attemptCount() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.attempts
+}
+
+func testNotifier(t *testing.T, configs ...Config) *Notifier {
+	for i := range configs {
+		configs[i].Secret = []byte("secret")
+		configs[i].MinBackoff = Duration(time.Millisecond)
+		configs[i].MaxBackoff = Duration(5 * time.Millisecond)
+	}
+	n, err := New(configs)
+	assert.NoError(t, err)
+	n.Start()
+	t.Cleanup(n.Stop)
+	return n
+}
+
+func TestDeliverySigned(t *testing.T) {
+	log.InitLogger("test", "debug")
+	rc := newReceiver()
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	n := testNotifier(t, Config{Name: "test", URL: srv.URL})
+
+	n.Notify(Change{Set: "set", Action: "Updated", Nets: []string{"10.0.0.1/32"}, Added: []string{"10.0.0.1/32"}, Removed: []string{}})
+	c := <-rc.received
+	assert.Equal(t, "set", c.Set)
+	assert.Equal(t, []string{"10.0.0.1/32"}, c.Added)
+	assert.False(t, c.Time.IsZero())
+
+	h := <-rc.headers
+	body := <-rc.bodies
+	assert.NotEmpty(t, h.Get(HeaderDelivery))
+	assert.Equal(t, "sha256="+Sign([]byte("secret"), h.Get(HeaderTimestamp), body), h.Get(HeaderSignature))
+	assert.NotEqual(t, "sha256="+Sign([]byte("other"), h.Get(HeaderTimestamp), body), h.Get(HeaderSignature))
+}
+
+func TestDeliveryRetries(t *testing.T) {
+	log.InitLogger("test", "debug")
+
+	// Server errors are retried
+	rc := newReceiver(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	n := testNotifier(t, Config{Name: "retry", URL: srv.URL, MaxAttempts: 3})
+	n.Notify(Change{Set: "set"})
+	<-rc.received
+	assert.Equal(t, 3, rc.attemptCount())
+
+	// until the attempts run out
+	rc = newReceiver(500, 500, 500)
+	srv2 := httptest.NewServer(rc)
+	defer srv2.Close()
+	n = testNotifier(t, Config{Name: "exhausted", URL: srv2.URL, MaxAttempts: 2})
+	n.Notify(Change{Set: "set"})
+	assert.Eventually(t, func() bool { return rc.attemptCount() == 2 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 2, rc.attemptCount())
+
+	// and client errors are not retried
+	rc = newReceiver(http.StatusBadRequest)
+	srv3 := httptest.NewServer(rc)
+	defer srv3.Close()
+	n = testNotifier(t, Config{Name: "rejected", URL: srv3.URL, MaxAttempts: 3})
+	n.Notify(Change{Set: "set"})
+	n.Notify(Change{Set: "next"})
+	// deliveries are made in order
+	assert.Equal(t, "next", (<-rc.received).Set)
+	assert.Equal(t, 2, rc.attemptCount())
+}
+
+func TestNotifySelector(t *testing.T) {
+	log.InitLogger("test", "debug")
+	rc := newReceiver()
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	n := testNotifier(t, Config{Name: "selected", URL: srv.URL, Selector: map[string]string{"team": "edge"}})
+
+	n.Notify(Change{Set: "other", Labels: map[string]string{"team": "core"}})
+	n.Notify(Change{Set: "unlabelled"})
+	n.Notify(Change{Set: "edge", Labels: map[string]string{"team": "edge", "app": "fw"}})
+	assert.Equal(t, "edge", (<-rc.received).Set)
+	assert.Equal(t, 1, rc.attemptCount())
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	assert.NoError(t, os.WriteFile(secret, []byte("s3cret\n"), 0600))
+	path := filepath.Join(dir, "webhooks.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+- name: edge-firewall
+  url: https://firewall.example.com/hooks/sets
+  secretFile: `+secret+`
+  selector:
+    policy.semaphore.uw.io/namespace: edge
+  timeout: 5s
+  maxAttempts: 3
+`), 0600))
+	configs, err := LoadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(configs))
+	assert.Equal(t, "edge-firewall", configs[0].Name)
+	assert.Equal(t, Duration(5*time.Second), configs[0].Timeout)
+	assert.Equal(t, []byte("s3cret"), configs[0].Secret)
+	assert.Equal(t, map[string]string{"policy.semaphore.uw.io/namespace": "edge"}, configs[0].Selector)
+	_, err = New(configs)
+	assert.NoError(t, err)
+
+	// A secret is required
+	assert.NoError(t, os.WriteFile(path, []byte(`[{"name": "nosecret", "url": "https://example.com"}]`), 0600))
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+	_, err = New([]Config{{Name: "invalid", URL: "ftp://example.com", Secret: []byte("s")}})
+	assert.Error(t, err)
+}